@@ -0,0 +1,240 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/// Assembler assembles source files into a Program, for a particular ControlUnit.
+/// Each assembly allocates data and bss memory afresh, in its own SymbolTable, so Assemblers are independent,
+/// and separate Assemblers may run concurrently. Running out of memory is a Diagnostic, like any other error.
+type Assembler struct {
+	cu      *ControlUnitData
+	program Program
+
+	IncludePaths []string ///< directories searched for .include files, after the directory of the including file
+	Listing      Listing  ///< the source line of each instruction assembled
+}
+
+func NewAssembler(cu *ControlUnitData, program Program) *Assembler {
+	return &Assembler{cu: cu, program: program}
+}
+
+/// AssembleFile reads and assembles the given source file
+func (a *Assembler) AssembleFile(file string) error {
+	source, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return a.Assemble(file, string(source))
+}
+
+/// @param file the name of the source file, used in diagnostics and to find included files
+/// @return Diagnostics for every error in the source, or nil
+func (a *Assembler) Assemble(file string, source string) error {
+	a.Listing.Record(a.program, SourceLine{}) // instructions already in the program have no source here
+	symbols := NewSymbolTable(a.cu, a.program.Size())
+
+	// first pass: define every symbol
+	lines, diags := a.include(file, source, nil)
+	lines, macroDiags := ExpandMacros(RemoveBlanks(lines))
+	diags = append(diags, macroDiags...)
+	lines, machineDiags := a.checkMachine(lines)
+	diags = append(diags, machineDiags...)
+	lines, pseudoOpDiags := ParsePseudoOperations(lines, symbols)
+	diags = append(diags, pseudoOpDiags...)
+	lines, labelDiags := ParseLabels(lines, symbols)
+	diags = append(diags, labelDiags...)
+	diags = append(diags, CheckConditionals(lines)...)
+
+	// second pass: evaluate and assemble
+	long := a.relaxJumps(lines, symbols)
+	a.assemblePseudoOperations(symbols)
+	diags = append(diags, ReplaceLabels(lines, long, symbols.Lookup, a.program, a.cu.Network(), &a.Listing)...)
+	diags = append(diags, symbols.Diags...)
+	return diags.Err()
+}
+
+/// Removes the .machine directive, and checks it matches the machine being assembled for,
+/// since the program would be laid out for the wrong machine otherwise
+func (a *Assembler) checkMachine(lines []SourceLine) ([]SourceLine, Diagnostics) {
+	arch := StringToArchitecture(a.program.Arch())
+	machine := NewProgramHeader(arch, a.cu)
+	lines, directive, diags := ParseMachine(lines, &machine)
+	if directive == nil || len(diags) != 0 {
+		return lines, diags
+	}
+	if mismatches := machine.Mismatches(arch, a.cu); len(mismatches) != 0 {
+		diags = append(diags, NewLineDiagnostic(*directive, "the program is for a different machine: %s", strings.Join(mismatches, ", ")))
+	}
+	return lines, diags
+}
+
+/// Finds the jumps whose targets don't fit in the jump field, which must be extended by an ext instruction.
+/// Extending a jump moves every later label, which may push other targets out of range, so this repeats until nothing changes.
+/// Jumps are never shortened again, so it always finishes. The symbol table is left with the final addresses.
+/// @return whether each line is a long jump
+func (a *Assembler) relaxJumps(lines []SourceLine, symbols *SymbolTable) []bool {
+	numDiags := len(symbols.Diags) // errors are reported when assembling, with the final addresses
+	long := make([]bool, len(lines), len(lines))
+	for changed := true; changed; {
+		changed = false
+		symbols.SetAddresses(lineAddresses(long))
+		for i, line := range lines {
+			if long[i] {
+				continue
+			}
+			op, target, ok := jumpTarget(line, symbols.Lookup)
+			if ok && !fitsBits(target, a.program.OperandBits(op, jumpOperand(op))) && fitsBits(target, maxOperandBits(a.program, op, jumpOperand(op))) {
+				long[i] = true
+				changed = true
+			}
+		}
+	}
+	symbols.SetAddresses(lineAddresses(long))
+	symbols.Diags = symbols.Diags[:numDiags]
+	return long
+}
+
+/// @return the instruction index of each line, and of the end of the program, where each long jump is 2 instructions
+func lineAddresses(long []bool) []int64 {
+	addresses := make([]int64, len(long)+1, len(long)+1)
+	for i, isLong := range long {
+		addresses[i+1] = addresses[i] + 1
+		if isLong {
+			addresses[i+1]++
+		}
+	}
+	return addresses
+}
+
+/// Evaluates every pseudo-op, and puts data and initial bss values in the program's data section.
+/// Errors are added to the symbol table's Diags.
+func (a *Assembler) assemblePseudoOperations(symbols *SymbolTable) {
+	bytesPerPe := len(a.cu.Memory) / (len(a.cu.PE) + 1)
+	for _, sym := range symbols.PseudoOps {
+		location := symbols.Resolve(sym)
+		if sym.state == ssFailed {
+			continue
+		}
+		switch sym.Kind {
+		case skData:
+			val, err := evaluateValue(sym.Line, sym.Value, symbols.Lookup, a.cu.Float)
+			if err != nil {
+				symbols.Diags = append(symbols.Diags, *err)
+				continue
+			}
+			a.program.StoreData(int(location), val)
+			a.Listing.RecordData(int(location), 1, sym.Line)
+		case skBss:
+			if sym.Init == nil {
+				continue
+			}
+			values, initDiags := evaluateBssInit(sym.Line, *sym.Init, int(sym.width*sym.height), symbols.Lookup, a.cu.Float)
+			symbols.Diags = append(symbols.Diags, initDiags...)
+			for col := 0; col < int(sym.width) && values != nil; col++ {
+				// stored by column, one column per PE, like loadMatrix
+				column := make([]int64, sym.height, sym.height)
+				for row := range column {
+					column[row] = values[row*int(sym.width)+col]
+				}
+				a.program.StoreData(col*bytesPerPe+int(location), column...)
+				a.Listing.RecordData(col*bytesPerPe+int(location), len(column), sym.Line)
+			}
+		case skInit:
+			values, initDiags := evaluateInit(sym.Line, *sym.Init, symbols.Lookup, a.cu.Float)
+			symbols.Diags = append(symbols.Diags, initDiags...)
+			if int(location)+len(values) > len(a.cu.Memory) {
+				symbols.Diags = append(symbols.Diags, NewDiagnostic(sym.Line, *sym.Init, ".init of %d values at %d is past the end of memory, which is %d words", len(values), location, len(a.cu.Memory)))
+				continue
+			}
+			if len(values) != 0 {
+				a.program.StoreData(int(location), values...)
+				a.Listing.RecordData(int(location), len(values), sym.Line)
+			}
+		}
+	}
+}
+
+/// Splits the source into lines, replacing each `.include "file"` directive with the lines of that file.
+/// @param including the files currently being included, outermost first, to detect cycles
+func (a *Assembler) include(file string, source string, including []string) (lines []SourceLine, diags Diagnostics) {
+	if abs, err := filepath.Abs(file); err == nil {
+		including = append(including, abs)
+	}
+
+	for _, line := range SplitLines(file, source) {
+		tokens := line.Fields()
+		if len(tokens) == 0 || strings.ToLower(tokens[0].Text) != ".include" {
+			lines = append(lines, line)
+			continue
+		}
+
+		if len(tokens) < 2 {
+			diags = append(diags, NewDiagnostic(line, tokens[0], "expected '.include \"file\"'"))
+			continue
+		}
+		arg := Token{strings.TrimSpace(line.Code[tokens[1].Column-1:]), tokens[1].Column}
+		name, err := strconv.Unquote(arg.Text)
+		if err != nil || !strings.HasPrefix(arg.Text, "\"") {
+			diags = append(diags, NewDiagnostic(line, arg, "expected a quoted file name, got %s", arg.Text))
+			continue
+		}
+
+		path, source, err := a.findInclude(name, filepath.Dir(file))
+		if err != nil {
+			diags = append(diags, NewDiagnostic(line, arg, "cannot include '%s': %s", name, err.Error()))
+			continue
+		}
+
+		abs, _ := filepath.Abs(path)
+		if cycle := includeCycle(including, abs); cycle != "" {
+			diags = append(diags, NewDiagnostic(line, arg, "include cycle: %s", cycle))
+			continue
+		}
+
+		included, includeDiags := a.include(path, source, including)
+		lines = append(lines, included...)
+		diags = append(diags, includeDiags...)
+	}
+	return lines, diags
+}
+
+/// Looks for the file in dir, then each of the IncludePaths.
+/// @return the path the file was found at, and its contents
+func (a *Assembler) findInclude(name string, dir string) (path string, source string, err error) {
+	if filepath.IsAbs(name) {
+		bytes, err := ioutil.ReadFile(name)
+		return name, string(bytes), err
+	}
+
+	var firstErr error
+	for _, searchDir := range append([]string{dir}, a.IncludePaths...) {
+		path = filepath.Join(searchDir, name)
+		bytes, err := ioutil.ReadFile(path)
+		if err == nil {
+			return path, string(bytes), nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", "", firstErr
+}
+
+/// @return a description of the cycle, if file is already being included. Otherwise the empty string.
+func includeCycle(including []string, file string) string {
+	for i, f := range including {
+		if f != file {
+			continue
+		}
+		var names []string
+		for _, f := range including[i:] {
+			names = append(names, filepath.Base(f))
+		}
+		return strings.Join(append(names, filepath.Base(file)), " -> ")
+	}
+	return ""
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+/// .simd files start with a header describing the machine the program was compiled for, followed by the instructions,
+/// and the data section. All fields are little-endian.
+///
+///     offset  size  field
+///          0     4  magic, "SIMD"
+///          4     2  version
+///          6     2  architecture, as ArchitectureType
+///          8     4  numpe
+///         12     4  pemem
+///         16     4  indexregisters
+///         20     4  length of the instructions, in bytes
+///         24     4  number of data segments
+///         28     4  flags, e.g. flagFloat
+///         32     4  topology, as Topology
+///         36     4  CRC-32 (IEEE) of everything else in the file
+///         40        instructions
+///                   data segments, each a 4-byte memory address, a 4-byte count, and count 8-byte values
+///
+/// Files from before the header existed are just the instructions. They can only be loaded as legacy files.
+const (
+	programMagic        = "SIMD"
+	programVersion      = 1
+	programHeaderLength = 40 ///< the checksum is the header's last field
+)
+
+const (
+	flagFloat = 1 << iota ///< the program was compiled for float64 data
+)
+
+/// ProgramHeader is the machine configuration a program was compiled for
+type ProgramHeader struct {
+	Version        uint16
+	Arch           ArchitectureType
+	NumPE          uint32
+	PEMemory       uint32
+	IndexRegisters uint32
+	Flags          uint32
+	Topology       Topology
+}
+
+/// @return the header for a program compiled for the given architecture and Control Unit
+func NewProgramHeader(arch ArchitectureType, cu *ControlUnitData) ProgramHeader {
+	var flags uint32
+	if cu.Float {
+		flags |= flagFloat
+	}
+	return ProgramHeader{
+		Version:        programVersion,
+		Arch:           arch,
+		NumPE:          uint32(len(cu.PE)),
+		PEMemory:       uint32(len(cu.Memory) / (len(cu.PE) + 1)),
+		IndexRegisters: uint32(len(cu.IndexRegister)),
+		Flags:          flags,
+		Topology:       cu.Topology,
+	}
+}
+
+/// @return whether the program was compiled for float64 data
+func (h ProgramHeader) Float() bool {
+	return h.Flags&flagFloat != 0
+}
+
+/// Configure sets the field configured by the given flag, e.g. numpe, as for a .machine directive
+func (h *ProgramHeader) Configure(name string, value string) error {
+	switch name {
+	case "arch":
+		arch := StringToArchitecture(value)
+		if arch == isInvalidArchitecture {
+			return fmt.Errorf("unknown arch '%s'", value)
+		}
+		h.Arch = arch
+	case "numpe", "pemem", "indexregisters":
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid %s '%s'", name, value)
+		}
+		switch name {
+		case "numpe":
+			h.NumPE = uint32(n)
+		case "pemem":
+			h.PEMemory = uint32(n)
+		case "indexregisters":
+			h.IndexRegisters = uint32(n)
+		}
+	case "float":
+		float, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid float '%s', expected true or false", value)
+		}
+		h.Flags &^= flagFloat
+		if float {
+			h.Flags |= flagFloat
+		}
+	case "topology":
+		topology := StringToTopology(value)
+		if topology == isInvalidTopology {
+			return fmt.Errorf("unknown topology '%s'", value)
+		}
+		h.Topology = topology
+	default:
+		return fmt.Errorf("unknown flag '%s', expected arch, numpe, pemem, indexregisters, float or topology", name)
+	}
+	return nil
+}
+
+/// Check returns an error if the program can't run on the given architecture and Control Unit.
+/// Architectures with the same instruction encoding, like 24bit and 24bitpipelined, may run each other's programs.
+func (h ProgramHeader) Check(arch ArchitectureType, cu *ControlUnitData) error {
+	if mismatches := h.Mismatches(arch, cu); len(mismatches) != 0 {
+		return fmt.Errorf("program was compiled for a different machine: %s", strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+/// @return how the program's machine differs from the given architecture and Control Unit, e.g. "numpe 16, not 32", or nil if it can run on it
+func (h ProgramHeader) Mismatches(arch ArchitectureType, cu *ControlUnitData) []string {
+	machine := NewProgramHeader(arch, cu)
+	var mismatches []string
+	if h.Arch.InstructionLength() != arch.InstructionLength() {
+		mismatches = append(mismatches, fmt.Sprintf("arch %s, not %s", h.Arch.String(), arch.String()))
+	}
+	if h.NumPE != machine.NumPE {
+		mismatches = append(mismatches, fmt.Sprintf("numpe %d, not %d", h.NumPE, machine.NumPE))
+	}
+	if h.PEMemory != machine.PEMemory {
+		mismatches = append(mismatches, fmt.Sprintf("pemem %d, not %d", h.PEMemory, machine.PEMemory))
+	}
+	if h.IndexRegisters != machine.IndexRegisters {
+		mismatches = append(mismatches, fmt.Sprintf("indexregisters %d, not %d", h.IndexRegisters, machine.IndexRegisters))
+	}
+	if h.Float() != machine.Float() {
+		mismatches = append(mismatches, fmt.Sprintf("%s data, not %s", dataModeName(h.Float()), dataModeName(machine.Float())))
+	}
+	if h.Topology != machine.Topology {
+		mismatches = append(mismatches, fmt.Sprintf("topology %s, not %s", h.Topology.String(), machine.Topology.String()))
+	}
+	return mismatches
+}
+
+/// SaveProgram writes the header and program to the given file
+func SaveProgram(file string, header ProgramHeader, program Program) error {
+	var code []byte
+	for i := int64(0); i < program.Size(); i++ {
+		code = append(code, program.At(i)...)
+	}
+
+	var data bytes.Buffer
+	for _, segment := range program.Data() {
+		binary.Write(&data, binary.LittleEndian, uint32(segment.Address))
+		binary.Write(&data, binary.LittleEndian, uint32(len(segment.Values)))
+		binary.Write(&data, binary.LittleEndian, segment.Values)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(programMagic)
+	binary.Write(&buf, binary.LittleEndian, uint16(programVersion))
+	binary.Write(&buf, binary.LittleEndian, uint16(header.Arch))
+	binary.Write(&buf, binary.LittleEndian, header.NumPE)
+	binary.Write(&buf, binary.LittleEndian, header.PEMemory)
+	binary.Write(&buf, binary.LittleEndian, header.IndexRegisters)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(code)))
+	binary.Write(&buf, binary.LittleEndian, uint32(len(program.Data())))
+	binary.Write(&buf, binary.LittleEndian, header.Flags)
+	binary.Write(&buf, binary.LittleEndian, uint32(header.Topology))
+	checksum := crc32.ChecksumIEEE(append(append(append([]byte{}, buf.Bytes()...), code...), data.Bytes()...))
+	binary.Write(&buf, binary.LittleEndian, checksum)
+	buf.Write(code)
+	buf.Write(data.Bytes())
+	return ioutil.WriteFile(file, buf.Bytes(), 0644)
+}
+
+/// LoadProgram reads a program file.
+///
+/// @param legacy whether to load files without a header, as the instructions of the given arch
+/// @param arch the architecture of legacy files. Files with a header are loaded as their own arch.
+/// @return the program, and its header. The header is nil for legacy files.
+func LoadProgram(file string, legacy bool, arch ArchitectureType) (Program, *ProgramHeader, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(programMagic)) {
+		if !legacy {
+			return nil, nil, fmt.Errorf("%s has no header; if it was compiled by an older version, run it with -legacy", file)
+		}
+		program, err := newProgramFromCode(arch, data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", file, err.Error())
+		}
+		return program, nil, nil
+	}
+
+	le := binary.LittleEndian
+	if len(data) < 6 {
+		return nil, nil, fmt.Errorf("%s: header is truncated", file)
+	}
+	version := le.Uint16(data[4:])
+	if version != programVersion {
+		return nil, nil, fmt.Errorf("%s: unsupported version %d, expected %d", file, version, programVersion)
+	}
+	if len(data) < programHeaderLength {
+		return nil, nil, fmt.Errorf("%s: header is truncated", file)
+	}
+	header := ProgramHeader{
+		Version:        version,
+		Arch:           ArchitectureType(le.Uint16(data[6:])),
+		NumPE:          le.Uint32(data[8:]),
+		PEMemory:       le.Uint32(data[12:]),
+		IndexRegisters: le.Uint32(data[16:]),
+		Flags:          le.Uint32(data[28:]),
+		Topology:       Topology(le.Uint32(data[32:])),
+	}
+	if header.Arch.String() == "NUL" {
+		return nil, nil, fmt.Errorf("%s: unknown architecture %d", file, header.Arch)
+	}
+	if header.Flags&^flagFloat != 0 {
+		return nil, nil, fmt.Errorf("%s: unknown flags %#x", file, header.Flags)
+	}
+	if header.Topology.String() == "NUL" {
+		return nil, nil, fmt.Errorf("%s: unknown topology %d", file, header.Topology)
+	}
+	checksumStart := programHeaderLength - 4
+	checksum := le.Uint32(data[checksumStart:])
+	if crc32.ChecksumIEEE(append(append([]byte{}, data[:checksumStart]...), data[programHeaderLength:]...)) != checksum {
+		return nil, nil, fmt.Errorf("%s: checksum mismatch, the file is corrupt", file)
+	}
+
+	codeLength := uint64(le.Uint32(data[20:]))
+	rest := data[programHeaderLength:]
+	if uint64(len(rest)) < codeLength {
+		return nil, nil, fmt.Errorf("%s: expected %d bytes of instructions, but the file has %d", file, codeLength, len(rest))
+	}
+	program, err := newProgramFromCode(header.Arch, rest[:codeLength])
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+	rest = rest[codeLength:]
+
+	numSegments := le.Uint32(data[24:])
+	for i := uint32(0); i < numSegments; i++ {
+		if len(rest) < 8 {
+			return nil, nil, fmt.Errorf("%s: data segment %d is truncated", file, i)
+		}
+		address := le.Uint32(rest)
+		count := uint64(le.Uint32(rest[4:]))
+		rest = rest[8:]
+		if uint64(len(rest)) < count*8 {
+			return nil, nil, fmt.Errorf("%s: data segment %d is truncated", file, i)
+		}
+		values := make([]int64, count, count)
+		for j := range values {
+			values[j] = int64(le.Uint64(rest[j*8:]))
+		}
+		rest = rest[count*8:]
+		program.StoreData(int(address), values...)
+	}
+	if len(rest) != 0 {
+		return nil, nil, fmt.Errorf("%s: %d unexpected bytes after the data section", file, len(rest))
+	}
+	return program, &header, nil
+}
+
+/// LoadProgramFor reads a program file, and checks it was compiled for the given architecture and Control Unit.
+/// Legacy files without a header are loaded if cu.Legacy is set, but can't be checked.
+func LoadProgramFor(file string, arch ArchitectureType, cu *ControlUnitData) (Program, error) {
+	program, header, err := LoadProgram(file, cu.Legacy, arch)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		if err := header.Check(arch, cu); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err.Error())
+		}
+	}
+	return program, nil
+}
+
+func newProgramFromCode(arch ArchitectureType, code []byte) (Program, error) {
+	if len(code)%arch.InstructionLength() != 0 {
+		return nil, fmt.Errorf("%d bytes is not a whole number of %d-byte %s instructions", len(code), arch.InstructionLength(), arch.String())
+	}
+	if arch == at32bit {
+		return &Program32bit{Code: code}, nil
+	}
+	return &Program24bit{Code: code}, nil
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"strings"
 )
 
+const DefaultReturnStackDepth = 16
+const DefaultMaskStackDepth = 16
+
 /// @todo rename this, and ducks
 type ControlUnit interface {
 	Run(file string) error
@@ -15,11 +21,20 @@ type ControlUnit interface {
 type ControlUnitData struct {
 	IndexRegister      []int64
 	ArithmeticRegister int64
-	Mask               []bool
-	LengthRegister     int64 // necessary?
+	Mask               []bool ///< the enable bit of each PE, as of the last instruction to change them
+	LengthRegister     int64  // necessary?
 	PE                 []ProcessingElement
 	Memory             []int64
-	Verbose            bool ///< whether to print verbose details during execution
+	Verbose            bool     ///< whether to print verbose details during execution
+	Legacy             bool     ///< whether to run legacy program files, which have no header to check against the machine
+	Float              bool     ///< whether data is float64, stored as its bits. Set with SetFloat.
+	Topology           Topology ///< how the PEs are connected, for routing instructions
+	ReductionSteps     int64    ///< the tree levels of every reduce this run, ceil(log2(numpe)) each, for a cycle model to charge. Printed with the machine.
+	JumpExtension      int64    ///< high bits of the next jump target, set by ext. Cleared by every other instruction.
+	ReturnStack        []int64  ///< the return address of each call, innermost last
+	ReturnStackDepth   int      ///< the most calls which may be nested. Calling deeper is a fault.
+	MaskStack          [][]bool ///< the Mask of each enclosing vif, innermost last
+	MaskStackDepth     int      ///< the most vifs which may be nested. Nesting deeper is a fault.
 	Done               chan bool
 }
 
@@ -33,8 +48,13 @@ func NewControlUnitData(indexRegisters uint, processingElements uint, memoryByte
 	d.Memory = make([]int64, memory, memory)
 	d.IndexRegister = make([]int64, indexRegisters, indexRegisters)
 	d.Mask = make([]bool, processingElements, processingElements)
+	for i := range d.Mask {
+		d.Mask[i] = true
+	}
 	d.PE = make([]ProcessingElement, processingElements, processingElements)
 	d.Done = make(chan bool, processingElements)
+	d.ReturnStackDepth = DefaultReturnStackDepth
+	d.MaskStackDepth = DefaultMaskStackDepth
 
 	for i, _ := range d.PE {
 		mpos := i * int(memoryBytesPerElement)
@@ -53,19 +73,241 @@ func NewControlUnitData(indexRegisters uint, processingElements uint, memoryByte
 		pe.Rsub = make(chan bool)
 		pe.Rmul = make(chan bool)
 		pe.Rdiv = make(chan bool)
+		pe.Cmp = make(chan CompareTuple)
+		pe.Rcmp = make(chan Condition)
+		pe.Zcmp = make(chan Condition)
+		pe.Logic = make(chan LogicTuple)
+		pe.Rlogic = make(chan OpCode)
 		pe.Done = d.Done
 		go pe.Run()
 	}
 	return &d
 }
 
+/// PushReturn pushes the return address of a call
+/// @return a fault if the return stack is full
+func (cu *ControlUnitData) PushReturn(address int64) error {
+	if len(cu.ReturnStack) >= cu.ReturnStackDepth {
+		return fmt.Errorf("return stack overflow: more than %d nested calls", cu.ReturnStackDepth)
+	}
+	cu.ReturnStack = append(cu.ReturnStack, address)
+	return nil
+}
+
+/// PopReturn pops the return address of the innermost call
+/// @return a fault if there is no call to return from
+func (cu *ControlUnitData) PopReturn() (int64, error) {
+	if len(cu.ReturnStack) == 0 {
+		return 0, errors.New("return stack underflow: ret without a call")
+	}
+	address := cu.ReturnStack[len(cu.ReturnStack)-1]
+	cu.ReturnStack = cu.ReturnStack[:len(cu.ReturnStack)-1]
+	return address, nil
+}
+
+/// SetFloat sets whether data is float64 or int64, in PE and CU memory, and in the PEs' registers and the CU's AR.
+/// The PEs do arithmetic and compares accordingly. Index registers are always integers, which ldx and stx convert from and to data.
+/// Either way, memory and registers hold 64 bits, and moves, bitwise and shift instructions don't depend on it.
+func (cu *ControlUnitData) SetFloat(float bool) {
+	cu.Float = float
+	for i := range cu.PE {
+		cu.PE[i].Float = float
+	}
+}
+
+/// @return the name of the data mode, for messages
+func dataModeName(float bool) string {
+	if float {
+		return "float"
+	}
+	return "integer"
+}
+
+/// UpdateMask records the enable bit of every PE in the Mask. Call this after the PEs change them.
+func (cu *ControlUnitData) UpdateMask() {
+	for i := range cu.PE {
+		cu.Mask[i] = cu.PE[i].Enabled
+	}
+}
+
+/// CompareMask records the enable bits set by a compare, enable or mload in the Mask.
+/// Inside a vif, PEs which were disabled when it began stay disabled.
+func (cu *ControlUnitData) CompareMask() {
+	if len(cu.MaskStack) != 0 {
+		outer := cu.MaskStack[len(cu.MaskStack)-1]
+		for i := range cu.PE {
+			cu.PE[i].Enabled = cu.PE[i].Enabled && outer[i]
+		}
+	}
+	cu.UpdateMask()
+}
+
+/// Vif pushes the Mask, so the compares which follow only enable PEs which are enabled now
+/// @return a fault if the mask stack is full
+func (cu *ControlUnitData) Vif() error {
+	if len(cu.MaskStack) >= cu.MaskStackDepth {
+		return fmt.Errorf("mask stack overflow: more than %d nested vifs", cu.MaskStackDepth)
+	}
+	cu.MaskStack = append(cu.MaskStack, append([]bool(nil), cu.Mask...))
+	return nil
+}
+
+/// Velse enables the PEs which were enabled when the vif began, but aren't now, i.e. those which failed its compare
+/// @return a fault if there is no vif
+func (cu *ControlUnitData) Velse() error {
+	if len(cu.MaskStack) == 0 {
+		return errors.New("mask stack underflow: velse without a vif")
+	}
+	outer := cu.MaskStack[len(cu.MaskStack)-1]
+	for i := range cu.PE {
+		cu.PE[i].Enabled = outer[i] && !cu.PE[i].Enabled
+	}
+	cu.UpdateMask()
+	return nil
+}
+
+/// Vendif pops the Mask pushed by the innermost vif, enabling the PEs which were enabled when it began
+/// @return a fault if there is no vif
+func (cu *ControlUnitData) Vendif() error {
+	if len(cu.MaskStack) == 0 {
+		return errors.New("mask stack underflow: vendif without a vif")
+	}
+	outer := cu.MaskStack[len(cu.MaskStack)-1]
+	cu.MaskStack = cu.MaskStack[:len(cu.MaskStack)-1]
+	for i := range cu.PE {
+		cu.PE[i].Enabled = outer[i]
+	}
+	cu.UpdateMask()
+	return nil
+}
+
+/// EnableAll enables every PE, except inside a vif, where it enables those which were enabled when the vif began
+func (cu *ControlUnitData) EnableAll() {
+	for i := range cu.PE {
+		cu.PE[i].Enabled = true
+	}
+	cu.CompareMask()
+}
+
+/// StoreMask stores the Mask in CU Memory at address a.
+/// Each word holds the bits of 64 PEs, PE 0 in the lowest bit, so more than 64 PEs take more than one word.
+/// The words are bits, rather than data, so aren't floats in float mode.
+func (cu *ControlUnitData) StoreMask(a uint16) {
+	for i := 0; i < len(cu.Mask); i += 64 {
+		cu.Memory[int(a)+i/64] = 0
+	}
+	for i, enabled := range cu.Mask {
+		if enabled {
+			cu.Memory[int(a)+i/64] |= 1 << uint(i%64)
+		}
+	}
+}
+
+/// LoadMask sets the enable bit of every PE from the Mask stored in CU Memory at address a by StoreMask.
+/// Inside a vif, PEs which were disabled when it began stay disabled.
+func (cu *ControlUnitData) LoadMask(a uint16) {
+	for i := range cu.PE {
+		cu.PE[i].Enabled = cu.Memory[int(a)+i/64]&(1<<uint(i%64)) != 0
+	}
+	cu.CompareMask()
+}
+
+/// @return the topology of the machine, and how many PEs it connects
+func (cu *ControlUnitData) Network() Network {
+	return Network{cu.Topology, len(cu.PE)}
+}
+
+/// Route moves every PE's RR distance steps in the direction, over the Network, for shift and rotate.
+/// Only enabled PEs receive a value, but every PE sends one, so disabled PEs keep their RR and still pass it on.
+/// @param wrap whether RRs moved past one end of the PEs come in at the other, as for rotate.
+///        Otherwise they're lost, and PEs with nothing moved into them receive zero, as for shift.
+/// @return a fault if the network has no links in the direction
+func (cu *ControlUnitData) Route(dir Direction, distance int64, wrap bool) error {
+	network := cu.Network()
+	if !network.HasDirection(dir) {
+		return fmt.Errorf("a %s of %d PEs has no direction %s", network.Topology.String(), network.NumPE, dir.String())
+	}
+	sent := make([]int64, len(cu.PE), len(cu.PE))
+	for i := range cu.PE {
+		sent[i] = cu.PE[i].RoutingRegister
+	}
+	for i := range cu.PE {
+		if !cu.PE[i].Enabled {
+			continue
+		}
+		if from, ok := network.Source(i, dir, distance, wrap); ok {
+			cu.PE[i].RoutingRegister = sent[from]
+		} else {
+			cu.PE[i].RoutingRegister = 0
+		}
+	}
+	return nil
+}
+
+/// Reduce combines the AR of every enabled PE into the CU's AR, by the reduction.
+/// It's modelled as a tree: each level combines pairs of the values of the level before, so it takes ceil(log2(numpe)) levels,
+/// which are added to ReductionSteps. Disabled PEs give the reduction's identity, so don't change the result.
+/// Float sums and products are rounded in the order of the tree, which may differ from adding the PEs in order.
+func (cu *ControlUnitData) Reduce(r Reduction) {
+	values := make([]int64, len(cu.PE), len(cu.PE))
+	for i := range cu.PE {
+		switch {
+		case !cu.PE[i].Enabled:
+			values[i] = r.Identity(cu.Float)
+		case r == redCount:
+			values[i] = toData(1, cu.Float)
+		default:
+			values[i] = cu.PE[i].ArithmeticRegister
+		}
+	}
+	for stride := 1; stride < len(values); stride *= 2 {
+		for i := 0; i+stride < len(values); i += 2 * stride {
+			values[i] = r.Combine(values[i], values[i+stride], cu.Float)
+		}
+		cu.ReductionSteps++
+	}
+	if len(values) == 0 {
+		cu.ArithmeticRegister = r.Identity(cu.Float)
+		return
+	}
+	cu.ArithmeticRegister = values[0]
+}
+
+/// @return the value a compare-and-branch instruction compares to: index register b, or b itself for the immediate forms like cmpxi
+func (cu *ControlUnitData) CompareOperand(op OpCode, b byte) int64 {
+	if isCompareImmediate(op) {
+		return int64(b)
+	}
+	return cu.IndexRegister[b]
+}
+
+/// LoadData copies the program's data section into Memory. Call this before running the program.
+func (cu *ControlUnitData) LoadData(program Program) error {
+	for _, segment := range program.Data() {
+		if segment.Address < 0 || segment.Address+len(segment.Values) > len(cu.Memory) {
+			return fmt.Errorf("data segment of %d values at %d is outside memory, which is %d words", len(segment.Values), segment.Address, len(cu.Memory))
+		}
+		copy(cu.Memory[segment.Address:], segment.Values)
+	}
+	return nil
+}
+
+/// PrintMachine prints the CU, then the PEs, laid out like their Network: a mesh one row at a time, and a hypercube numbered in binary
 func (cu *ControlUnitData) PrintMachine() {
 	cu.printCu()
-	cu.printPe()
-	cu.printMemory()
+	width := cu.Network().Width()
+	for first := 0; first < len(cu.PE); first += width {
+		last := first + width
+		if last > len(cu.PE) {
+			last = len(cu.PE)
+		}
+		cu.printPe(first, last)
+		cu.printMemory(first, last)
+	}
 }
 
-func (cu *ControlUnitData) printMemory() {
+/// prints the memory of PEs first to last, exclusive
+func (cu *ControlUnitData) printMemory(first int, last int) {
 	bytesPerPe := len(cu.Memory) / (len(cu.PE) + 1)
 	/*
 		fmt.Printf("PE: ")
@@ -74,68 +316,62 @@ func (cu *ControlUnitData) printMemory() {
 		}
 		fmt.Printf("\n")
 	*/
-	fmt.Printf("----")
-	for i := 0; i < len(cu.PE); i++ {
-		fmt.Printf("---")
-	}
-	fmt.Printf("\n")
+	fmt.Println(cu.bar())
 
 	for i := 0; i < bytesPerPe; i++ {
 		//		if i > 8 {
 		//			break //debug
 		//		}
 		fmt.Printf("    ")
-		for j := 0; j < len(cu.PE); j++ {
+		for j := first; j < last; j++ {
 			pe := cu.PE[j]
-			fmt.Printf("%3d", pe.Memory[i])
+			fmt.Print(cu.formatValue(pe.Memory[i]))
 		}
 		fmt.Printf("\n")
 	}
 
 }
 
-func (cu *ControlUnitData) printPe() {
+/// prints the registers of PEs first to last, exclusive
+func (cu *ControlUnitData) printPe(first int, last int) {
 	//	bytesPerPe := len(cu.Memory) / (len(cu.PE) + 1)
+	width := cu.columnWidth()
 	fmt.Printf("PE: ")
-	for i, _ := range cu.PE {
-		fmt.Printf("%3d", i)
+	for i := first; i < last; i++ {
+		fmt.Printf("%*s", width, cu.Network().Label(i))
 	}
 	fmt.Printf("\n")
 
-	fmt.Printf("----")
-	for i := 0; i < len(cu.PE); i++ {
-		fmt.Printf("---")
-	}
-	fmt.Printf("\n")
+	fmt.Println(cu.bar())
 
 	fmt.Printf("AR: ")
-	for j := 0; j < len(cu.PE); j++ {
+	for j := first; j < last; j++ {
 		pe := cu.PE[j]
-		fmt.Printf("%3d", pe.ArithmeticRegister)
+		fmt.Print(cu.formatValue(pe.ArithmeticRegister))
 	}
 	fmt.Printf("\n")
 
 	fmt.Printf("RR: ")
-	for j := 0; j < len(cu.PE); j++ {
+	for j := first; j < last; j++ {
 		pe := cu.PE[j]
-		fmt.Printf("%3d", pe.RoutingRegister)
+		fmt.Print(cu.formatValue(pe.RoutingRegister))
 	}
 	fmt.Printf("\n")
 
 	fmt.Printf("Ix: ")
-	for j := 0; j < len(cu.PE); j++ {
+	for j := first; j < last; j++ {
 		pe := cu.PE[j]
-		fmt.Printf("%3d", pe.Index)
+		fmt.Printf("%*d", width, pe.Index)
 	}
 	fmt.Printf("\n")
 
 	fmt.Printf("En: ")
-	for j := 0; j < len(cu.PE); j++ {
+	for j := first; j < last; j++ {
 		pe := cu.PE[j]
 		if pe.Enabled {
-			fmt.Printf("%3d", 1)
+			fmt.Printf("%*d", width, 1)
 		} else {
-			fmt.Printf("%3d", 0)
+			fmt.Printf("%*d", width, 0)
 		}
 	}
 	fmt.Printf("\n")
@@ -145,7 +381,7 @@ func (cu *ControlUnitData) printPe() {
 func (cu *ControlUnitData) printCu() {
 	/// @todo print Mask, Memory?
 	/// @todo print Program Counter
-	fmt.Printf("AR: %d  LR: %d\nIR: %d\nMask: ", cu.ArithmeticRegister, cu.LengthRegister, cu.IndexRegister)
+	fmt.Printf("AR: %s  LR: %d  Reduction steps: %d\nIR: %d\nMask: ", strings.TrimSpace(cu.formatValue(cu.ArithmeticRegister)), cu.LengthRegister, cu.ReductionSteps, cu.IndexRegister)
 	for i := 0; i < len(cu.Mask); i++ {
 		if cu.Mask[i] {
 			fmt.Printf("1  ")
@@ -161,12 +397,33 @@ func (cu *ControlUnitData) printCu() {
 		if i != cuMemoryBegin && i%len(cu.PE) == 0 {
 			fmt.Print("\n    ")
 		}
-		fmt.Printf("%3d", cu.Memory[i])
+		fmt.Print(cu.formatValue(cu.Memory[i]))
+	}
+
+	fmt.Println("\n" + cu.bar())
+}
+
+/// @return the width of each PE's column, when printing the machine. Columns are widened to fit the longest PE label.
+func (cu *ControlUnitData) columnWidth() int {
+	width := 3
+	if cu.Float {
+		width = 11
+	}
+	if label := len(cu.Network().Label(len(cu.PE)-1)) + 1; label > width {
+		width = label
 	}
+	return width
+}
+
+/// @return the line between sections, when printing the machine
+func (cu *ControlUnitData) bar() string {
+	return "----" + strings.Repeat("-", cu.columnWidth()*cu.Network().Width())
+}
 
-	bar := "----"
-	for i := 0; i < len(cu.PE); i++ {
-		bar += "---"
+/// @return the value of a register or memory word, formatted as an integer or float, padded to the column width
+func (cu *ControlUnitData) formatValue(v int64) string {
+	if cu.Float {
+		return fmt.Sprintf("%*.4g", cu.columnWidth(), math.Float64frombits(uint64(v)))
 	}
-	fmt.Println("\n" + bar)
+	return fmt.Sprintf("%*d", cu.columnWidth(), v)
 }
@@ -2,10 +2,14 @@ package main
 
 import (
 	"fmt"
+	"math"
 )
 
 const NoJump = int64(-1)
 
+/// Halt is a jump position past the end of every program. Jumping to it stops the pipeline after a fault.
+const Halt = int64(math.MaxInt64)
+
 // used as a "union" for ExecuteChan
 type ExecuteParam interface {
 	IsMem() bool
@@ -59,7 +63,9 @@ func (p ExecuteMemParams) MemParam() uint16 {
 }
 
 type ControlUnit24bitPipelined struct {
-	data *ControlUnitData
+	data           *ControlUnitData
+	ProgramCounter int64 ///< the instruction being executed. The Fetcher and Decoder are ahead of it.
+	fault          error ///< the fault which stopped the program, if any
 
 	FetchWaitForPcChange chan bool
 	FetchPcChangeChan    chan int64
@@ -166,22 +172,8 @@ func Decoder(decode chan []byte,
 	for {
 		select {
 		case instruction := <-decode:
-			op := OpCode(instruction[0] & 63) // 63 = 00111111
-			if !isMem(op) {
-				param1 := instruction[0]>>6 | instruction[1]<<2&63
-				param2 := instruction[1]>>4 | instruction[2]<<4&63
-				param3 := instruction[2] >> 2
-				if !trySendExecute(execute, decodePause, decodeResume, (ExecuteParams{op, []byte{param1, param2, param3}}), decodeStop) {
-					return
-				}
-
-			} else {
-				param := instruction[0]>>6 | instruction[1]<<2&63
-				memParam := uint16(instruction[1]>>4) | uint16(instruction[2])<<4
-				params := ExecuteMemParams{op, param, memParam}
-				if !trySendExecute(execute, decodePause, decodeResume, params, decodeStop) {
-					return
-				}
+			if !trySendExecute(execute, decodePause, decodeResume, Decode24bit(instruction), decodeStop) {
+				return
 			}
 		case <-decodePause:
 			<-decodeResume
@@ -247,16 +239,27 @@ func Executor(cu *ControlUnit24bitPipelined,
 		case params := <-execute:
 			if params.IsMem() {
 				cu.ExecuteMem(params.Op(), params.Param(), params.MemParam())
+				if params.Op() != isExt {
+					cu.data.JumpExtension = 0
+				}
+				cu.ProgramCounter++
 				continue
 			}
-			jumpPos := cu.Execute(params.Op(), params.Params())
+			jumpPos, err := cu.Execute(params.Op(), params.Params())
+			cu.data.JumpExtension = 0
+			if err != nil {
+				cu.fault = fmt.Errorf("instruction %d: %s", cu.ProgramCounter, err.Error())
+				jumpPos = Halt
+			}
 			if jumpPos == NoJump {
+				cu.ProgramCounter++
 				continue
 			}
 			sendWaitForPc(fetchWaitForPcChange, execute, decodeFinished)
 			drainDecode(decode, decodePause, decodeResume, fetchFinished)
 			drainExecute(execute, decodeFinished)
 			fetchPcChange <- jumpPos
+			cu.ProgramCounter = jumpPos
 		case <-decodeFinished:
 			fetchStop <- true
 			decodeStop <- true
@@ -296,6 +299,10 @@ func (cu *ControlUnit24bitPipelined) PrintMachine() {
 }
 
 func (cu *ControlUnit24bitPipelined) RunProgram(program Program) error {
+	err := cu.data.LoadData(program)
+	if err != nil {
+		return err
+	}
 	pr, err := NewProgramReader24bitMem(program)
 	if err != nil {
 		return err
@@ -303,14 +310,19 @@ func (cu *ControlUnit24bitPipelined) RunProgram(program Program) error {
 	return cu.run(pr)
 }
 func (cu *ControlUnit24bitPipelined) Run(programFile string) error {
-	pr, err := NewProgramReader24bit(programFile)
+	program, err := LoadProgramFor(programFile, at24bitpipelined, cu.data)
 	if err != nil {
 		return err
 	}
-	return cu.run(pr)
+	return cu.RunProgram(program)
 }
 
 func (cu *ControlUnit24bitPipelined) run(pr ProgramReader) error {
+	cu.ProgramCounter = 0
+	cu.fault = nil
+	cu.data.ReturnStack = nil
+	cu.data.MaskStack = nil
+	cu.data.ReductionSteps = 0
 	go Fetcher(pr,
 		cu.DecodeChan,
 		cu.FetchWaitForPcChange,
@@ -338,7 +350,7 @@ func (cu *ControlUnit24bitPipelined) run(pr ProgramReader) error {
 		cu.Finished)
 
 	<-cu.Finished
-	return nil
+	return cu.fault
 }
 
 func (cu *ControlUnit24bitPipelined) ExecuteMem(instruction OpCode, param byte, memParam uint16) {
@@ -359,15 +371,28 @@ func (cu *ControlUnit24bitPipelined) ExecuteMem(instruction OpCode, param byte,
 		cu.Decx(param, memParam)
 	case isMulx:
 		cu.Mulx(param, memParam)
+	case isExt:
+		cu.Ext(memParam)
+	case isMload:
+		cu.Mload(memParam)
+	case isMstore:
+		cu.Mstore(memParam)
 	}
 }
 
 /// @param params must have as many members as the instruction takes parameters
-func (cu *ControlUnit24bitPipelined) Execute(instruction OpCode, params []byte) (jumpPos int64) {
+/// @return the position to jump to, or NoJump, and a fault which stops the program, e.g. a return stack overflow
+func (cu *ControlUnit24bitPipelined) Execute(instruction OpCode, params []byte) (jumpPos int64, err error) {
 	jumpPos = NoJump
 	switch instruction {
-	case isCmpx:
-		jumpPos = cu.Cmpx(params[0], params[1], params[2])
+	case isCmpx, isCmpxEq, isCmpxNe, isCmpxLe, isCmpxGt, isCmpxGe, isCmpxi, isCmpxEqi, isCmpxNei, isCmpxLei, isCmpxGti, isCmpxGei:
+		jumpPos = cu.Cmpx(instruction, params[0], params[1], params[2])
+	case isJmp:
+		jumpPos = cu.Jmp(params[0])
+	case isCall:
+		jumpPos, err = cu.Call(params[0])
+	case isRet:
+		jumpPos, err = cu.Ret()
 	case isCbcast:
 		cu.Cbcast()
 	case isLod:
@@ -394,6 +419,28 @@ func (cu *ControlUnit24bitPipelined) Execute(instruction OpCode, params []byte)
 		cu.Rmul()
 	case isRdiv:
 		cu.Rdiv()
+	case isVcmp:
+		cu.Vcmp(Condition(params[0]), params[1], params[2])
+	case isRcmp:
+		cu.Rcmp(Condition(params[0]))
+	case isZcmp:
+		cu.Zcmp(Condition(params[0]))
+	case isEnable:
+		cu.Enable()
+	case isAnd, isOr, isXor, isNot, isShl, isShr, isSar:
+		cu.Logic(instruction, params[0], params[1])
+	case isRand, isRor, isRxor, isRnot, isRshl, isRshr, isRsar:
+		cu.Rlogic(instruction)
+	case isReduce:
+		cu.data.Reduce(Reduction(params[0]))
+	case isShift, isRotate:
+		err = cu.data.Route(Direction(params[0]), cu.data.IndexRegister[params[1]], instruction == isRotate)
+	case isVif:
+		err = cu.data.Vif()
+	case isVelse:
+		err = cu.data.Velse()
+	case isVendif:
+		err = cu.data.Vendif()
 	}
 	return
 }
@@ -403,10 +450,10 @@ func (cu *ControlUnit24bitPipelined) Execute(instruction OpCode, params []byte)
 //
 func (cu *ControlUnit24bitPipelined) Ldx(index byte, a uint16) {
 	//	fmt.Printf("ldx: cu.index[%d] = cu.data.Memory[%d] (%d)"
-	cu.data.IndexRegister[index] = cu.data.Memory[a]
+	cu.data.IndexRegister[index] = fromData(cu.data.Memory[a], cu.data.Float)
 }
 func (cu *ControlUnit24bitPipelined) Stx(index byte, a uint16) {
-	cu.data.Memory[a] = cu.data.IndexRegister[index]
+	cu.data.Memory[a] = toData(cu.data.IndexRegister[index], cu.data.Float)
 }
 func (cu *ControlUnit24bitPipelined) Ldxi(index byte, a uint16) {
 	cu.data.IndexRegister[index] = int64(a)
@@ -427,16 +474,45 @@ func (cu *ControlUnit24bitPipelined) Cstore(index uint16) {
 	cu.data.Memory[index] = cu.data.ArithmeticRegister
 }
 
-/// @todo fix this to take a larger jump (a). Byte only allows for 256 instructions. That's not a very big program
-func (cu *ControlUnit24bitPipelined) Cmpx(index byte, ix2 byte, a byte) (jumpPos int64) {
-	if cu.data.IndexRegister[index] < cu.data.IndexRegister[ix2] {
-		jumpPos = int64(a)
+/// Ext sets the high bits of the next instruction's jump target, which are above its 6-bit field
+func (cu *ControlUnit24bitPipelined) Ext(high uint16) {
+	cu.data.JumpExtension = int64(high) << 6
+}
+
+/// Jumps to a, extended by the preceding ext, if any, if index register index compares to b by the instruction's condition.
+/// b is an index register, or an immediate value for the immediate forms like cmpxi.
+func (cu *ControlUnit24bitPipelined) Cmpx(op OpCode, index byte, b byte, a byte) (jumpPos int64) {
+	if branchCondition(op).Holds(cu.data.IndexRegister[index], cu.data.CompareOperand(op, b)) {
+		jumpPos = cu.data.JumpExtension | int64(a)
 	} else {
 		jumpPos = NoJump
 	}
 	return
 }
 
+/// Jumps to a, extended by the preceding ext, if any
+func (cu *ControlUnit24bitPipelined) Jmp(a byte) (jumpPos int64) {
+	return cu.data.JumpExtension | int64(a)
+}
+
+/// Pushes the address of the next instruction, and jumps to a, extended by the preceding ext, if any
+func (cu *ControlUnit24bitPipelined) Call(a byte) (jumpPos int64, err error) {
+	err = cu.data.PushReturn(cu.ProgramCounter + 1)
+	if err != nil {
+		return NoJump, err
+	}
+	return cu.Jmp(a), nil
+}
+
+/// Pops the address pushed by the innermost call, and jumps to it
+func (cu *ControlUnit24bitPipelined) Ret() (jumpPos int64, err error) {
+	address, err := cu.data.PopReturn()
+	if err != nil {
+		return NoJump, err
+	}
+	return address, nil
+}
+
 // control broadcast. Broadcasts the Control's Arithmetic Register to every PE's Routing Register
 func (cu *ControlUnit24bitPipelined) Cbcast() {
 	for i, _ := range cu.data.PE {
@@ -535,3 +611,55 @@ func (cu *ControlUnit24bitPipelined) Rdiv() {
 	}
 	cu.Barrier()
 }
+
+/// Sets the enable bit of each PE by comparing its AR to Memory[a+idx]
+func (cu *ControlUnit24bitPipelined) Vcmp(c Condition, a byte, idx byte) {
+	for i, _ := range cu.data.PE {
+		cu.data.PE[i].Cmp <- CompareTuple{c, a, byte(cu.data.IndexRegister[idx])}
+	}
+	cu.Barrier()
+	cu.data.CompareMask()
+}
+
+/// Sets the enable bit of each PE by comparing its AR to its RR
+func (cu *ControlUnit24bitPipelined) Rcmp(c Condition) {
+	for i, _ := range cu.data.PE {
+		cu.data.PE[i].Rcmp <- c
+	}
+	cu.Barrier()
+	cu.data.CompareMask()
+}
+
+/// Sets the enable bit of each PE by comparing its AR to zero
+func (cu *ControlUnit24bitPipelined) Zcmp(c Condition) {
+	for i, _ := range cu.data.PE {
+		cu.data.PE[i].Zcmp <- c
+	}
+	cu.Barrier()
+	cu.data.CompareMask()
+}
+func (cu *ControlUnit24bitPipelined) Mload(a uint16) {
+	cu.data.LoadMask(a)
+}
+func (cu *ControlUnit24bitPipelined) Mstore(a uint16) {
+	cu.data.StoreMask(a)
+}
+func (cu *ControlUnit24bitPipelined) Enable() {
+	cu.data.EnableAll()
+}
+
+/// Bitwise and shift instructions on each PE's AR and Memory[a+idx], like and
+func (cu *ControlUnit24bitPipelined) Logic(op OpCode, a byte, idx byte) {
+	for i, _ := range cu.data.PE {
+		cu.data.PE[i].Logic <- LogicTuple{op, a, byte(cu.data.IndexRegister[idx])}
+	}
+	cu.Barrier()
+}
+
+/// Bitwise and shift instructions on each PE's AR and RR, like rand
+func (cu *ControlUnit24bitPipelined) Rlogic(op OpCode) {
+	for i, _ := range cu.data.PE {
+		cu.data.PE[i].Rlogic <- op
+	}
+	cu.Barrier()
+}
@@ -28,40 +28,47 @@ func (cu *ControlUnit32bit) PrintMachine() {
 }
 
 func (cu *ControlUnit32bit) RunProgram(program Program) error {
+	err := cu.data.LoadData(program)
+	if err != nil {
+		return err
+	}
 	cu.ProgramCounter = 0
+	cu.data.ReturnStack = nil
+	cu.data.MaskStack = nil
+	cu.data.ReductionSteps = 0
 	for cu.ProgramCounter != int64(program.Size()) {
 		pc := cu.ProgramCounter
-		inst := program.At(pc)
-		op := OpCode(inst[0])
-		if !isMem(op) {
-			param1 := inst[1]
-			param2 := inst[2]
-			param3 := inst[3]
-
+		params := Decode32bit(program.At(pc))
+		op := params.Op()
+		if !params.IsMem() {
 			if cu.data.Verbose {
-				fmt.Printf("Run() PC: %3d  IS: %5s  P1: %d  P2: %d  P3: %d\n", cu.ProgramCounter, op.String(), param1, param2, param3) // debug
+				fmt.Printf("Run() PC: %3d  IS: %5s  P1: %d  P2: %d  P3: %d\n", cu.ProgramCounter, op.String(), params.Params()[0], params.Params()[1], params.Params()[2]) // debug
+			}
+			err := cu.Execute(op, params.Params())
+			if err != nil {
+				return fmt.Errorf("instruction %d: %s", pc, err.Error())
 			}
-			cu.Execute(op, []byte{param1, param2, param3})
 			if cu.data.Verbose {
 				cu.data.PrintMachine() // debug
 			}
 		} else {
-			param := inst[1]
-			memParam := uint16(inst[2]) | uint16(inst[3])<<8
 			if cu.data.Verbose {
-				fmt.Printf("Run() PC: %3d  IS: %5s  P: %d  MP: %d\n", cu.ProgramCounter, op.String(), param, memParam) // debug
+				fmt.Printf("Run() PC: %3d  IS: %5s  P: %d  MP: %d\n", cu.ProgramCounter, op.String(), params.Param(), params.MemParam()) // debug
 			}
-			cu.ExecuteMem(op, param, memParam)
+			cu.ExecuteMem(op, params.Param(), params.MemParam())
 			if cu.data.Verbose {
 				cu.data.PrintMachine() // debug
 			}
 		}
+		if op != isExt {
+			cu.data.JumpExtension = 0
+		}
 		cu.ProgramCounter++
 	}
 	return nil
 }
 func (cu *ControlUnit32bit) Run(file string) error {
-	program, err := LoadProgram32bit(file)
+	program, err := LoadProgramFor(file, at32bit, cu.data)
 	if err != nil {
 		return err
 	}
@@ -86,14 +93,27 @@ func (cu *ControlUnit32bit) ExecuteMem(op OpCode, param byte, memParam uint16) {
 		cu.Decx(param, memParam)
 	case isMulx:
 		cu.Mulx(param, memParam)
+	case isExt:
+		cu.Ext(memParam)
+	case isMload:
+		cu.Mload(memParam)
+	case isMstore:
+		cu.Mstore(memParam)
 	}
 }
 
 /// @param params must have as many members as the instruction takes parameters
-func (cu *ControlUnit32bit) Execute(instruction OpCode, params []byte) {
+/// @return a fault which stops the program, e.g. a return stack overflow
+func (cu *ControlUnit32bit) Execute(instruction OpCode, params []byte) error {
 	switch instruction {
-	case isCmpx:
-		cu.Cmpx(params[0], params[1], params[2])
+	case isCmpx, isCmpxEq, isCmpxNe, isCmpxLe, isCmpxGt, isCmpxGe, isCmpxi, isCmpxEqi, isCmpxNei, isCmpxLei, isCmpxGti, isCmpxGei:
+		cu.Cmpx(instruction, params[0], params[1], params[2])
+	case isJmp:
+		cu.Jmp(params[0])
+	case isCall:
+		return cu.Call(params[0])
+	case isRet:
+		return cu.Ret()
 	case isCbcast:
 		cu.Cbcast()
 	case isLod:
@@ -120,7 +140,30 @@ func (cu *ControlUnit32bit) Execute(instruction OpCode, params []byte) {
 		cu.Rmul()
 	case isRdiv:
 		cu.Rdiv()
+	case isVcmp:
+		cu.Vcmp(Condition(params[0]), params[1], params[2])
+	case isRcmp:
+		cu.Rcmp(Condition(params[0]))
+	case isZcmp:
+		cu.Zcmp(Condition(params[0]))
+	case isEnable:
+		cu.Enable()
+	case isAnd, isOr, isXor, isNot, isShl, isShr, isSar:
+		cu.Logic(instruction, params[0], params[1])
+	case isRand, isRor, isRxor, isRnot, isRshl, isRshr, isRsar:
+		cu.Rlogic(instruction)
+	case isReduce:
+		cu.data.Reduce(Reduction(params[0]))
+	case isShift, isRotate:
+		return cu.data.Route(Direction(params[0]), cu.data.IndexRegister[params[1]], instruction == isRotate)
+	case isVif:
+		return cu.data.Vif()
+	case isVelse:
+		return cu.data.Velse()
+	case isVendif:
+		return cu.data.Vendif()
 	}
+	return nil
 }
 
 //
@@ -128,10 +171,10 @@ func (cu *ControlUnit32bit) Execute(instruction OpCode, params []byte) {
 //
 func (cu *ControlUnit32bit) Ldx(index byte, a uint16) {
 	//	fmt.Printf("ldx: cu.data.index[%d] = cu.data.Memory[%d] (%d)"
-	cu.data.IndexRegister[index] = cu.data.Memory[a]
+	cu.data.IndexRegister[index] = fromData(cu.data.Memory[a], cu.data.Float)
 }
 func (cu *ControlUnit32bit) Stx(index byte, a uint16) {
-	cu.data.Memory[a] = cu.data.IndexRegister[index]
+	cu.data.Memory[a] = toData(cu.data.IndexRegister[index], cu.data.Float)
 }
 func (cu *ControlUnit32bit) Ldxi(index byte, a uint16) {
 	cu.data.IndexRegister[index] = int64(a)
@@ -152,11 +195,42 @@ func (cu *ControlUnit32bit) Cstore(index uint16) {
 	cu.data.Memory[index] = cu.data.ArithmeticRegister
 }
 
-/// @todo fix this to take a larger jump (a). Byte only allows for 256 instructions. That's not a very big program
-func (cu *ControlUnit32bit) Cmpx(index byte, ix2 byte, a byte) {
-	if cu.data.IndexRegister[index] < cu.data.IndexRegister[ix2] {
-		cu.ProgramCounter = int64(a) - 1 // -1 because the PC will be incremented.
+/// Ext sets the high bits of the next instruction's jump target, which are above its 8-bit field
+func (cu *ControlUnit32bit) Ext(high uint16) {
+	cu.data.JumpExtension = int64(high) << 8
+}
+
+/// Jumps to a, extended by the preceding ext, if any, if index register index compares to b by the instruction's condition.
+/// b is an index register, or an immediate value for the immediate forms like cmpxi.
+func (cu *ControlUnit32bit) Cmpx(op OpCode, index byte, b byte, a byte) {
+	if branchCondition(op).Holds(cu.data.IndexRegister[index], cu.data.CompareOperand(op, b)) {
+		cu.ProgramCounter = (cu.data.JumpExtension | int64(a)) - 1 // -1 because the PC will be incremented.
+	}
+}
+
+/// Jumps to a, extended by the preceding ext, if any
+func (cu *ControlUnit32bit) Jmp(a byte) {
+	cu.ProgramCounter = (cu.data.JumpExtension | int64(a)) - 1 // -1 because the PC will be incremented.
+}
+
+/// Pushes the address of the next instruction, and jumps to a, extended by the preceding ext, if any
+func (cu *ControlUnit32bit) Call(a byte) error {
+	err := cu.data.PushReturn(cu.ProgramCounter + 1)
+	if err != nil {
+		return err
 	}
+	cu.Jmp(a)
+	return nil
+}
+
+/// Pops the address pushed by the innermost call, and jumps to it
+func (cu *ControlUnit32bit) Ret() error {
+	address, err := cu.data.PopReturn()
+	if err != nil {
+		return err
+	}
+	cu.ProgramCounter = address - 1 // -1 because the PC will be incremented.
+	return nil
 }
 
 // control broadcast. Broadcasts the Control's Arithmetic Register to every PE's Routing Register
@@ -257,3 +331,55 @@ func (cu *ControlUnit32bit) Rdiv() {
 	}
 	cu.Barrier()
 }
+
+/// Sets the enable bit of each PE by comparing its AR to Memory[a+idx]
+func (cu *ControlUnit32bit) Vcmp(c Condition, a byte, idx byte) {
+	for i, _ := range cu.data.PE {
+		cu.data.PE[i].Cmp <- CompareTuple{c, a, byte(cu.data.IndexRegister[idx])}
+	}
+	cu.Barrier()
+	cu.data.CompareMask()
+}
+
+/// Sets the enable bit of each PE by comparing its AR to its RR
+func (cu *ControlUnit32bit) Rcmp(c Condition) {
+	for i, _ := range cu.data.PE {
+		cu.data.PE[i].Rcmp <- c
+	}
+	cu.Barrier()
+	cu.data.CompareMask()
+}
+
+/// Sets the enable bit of each PE by comparing its AR to zero
+func (cu *ControlUnit32bit) Zcmp(c Condition) {
+	for i, _ := range cu.data.PE {
+		cu.data.PE[i].Zcmp <- c
+	}
+	cu.Barrier()
+	cu.data.CompareMask()
+}
+func (cu *ControlUnit32bit) Mload(a uint16) {
+	cu.data.LoadMask(a)
+}
+func (cu *ControlUnit32bit) Mstore(a uint16) {
+	cu.data.StoreMask(a)
+}
+func (cu *ControlUnit32bit) Enable() {
+	cu.data.EnableAll()
+}
+
+/// Bitwise and shift instructions on each PE's AR and Memory[a+idx], like and
+func (cu *ControlUnit32bit) Logic(op OpCode, a byte, idx byte) {
+	for i, _ := range cu.data.PE {
+		cu.data.PE[i].Logic <- LogicTuple{op, a, byte(cu.data.IndexRegister[idx])}
+	}
+	cu.Barrier()
+}
+
+/// Bitwise and shift instructions on each PE's AR and RR, like rand
+func (cu *ControlUnit32bit) Rlogic(op OpCode) {
+	for i, _ := range cu.data.PE {
+		cu.data.PE[i].Rlogic <- op
+	}
+	cu.Barrier()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/// Diagnostic is an assembler error, located in the original source file
+type Diagnostic struct {
+	File    string
+	Line    int    ///< 1-based line number in File
+	Column  int    ///< 1-based column of Token. 0 if the error is about the whole line
+	Token   string ///< the offending token, if any
+	Message string
+}
+
+func NewDiagnostic(line SourceLine, token Token, format string, args ...interface{}) Diagnostic {
+	message := fmt.Sprintf(format, args...)
+	for expansion := line.Expansion; expansion != nil; expansion = expansion.Expansion {
+		message += fmt.Sprintf(", in macro expanded at %s:%d", expansion.File, expansion.Number)
+	}
+	return Diagnostic{
+		File:    line.File,
+		Line:    line.Number,
+		Column:  token.Column,
+		Token:   token.Text,
+		Message: message,
+	}
+}
+
+/// NewLineDiagnostic creates a Diagnostic for a line as a whole, rather than a particular token
+func NewLineDiagnostic(line SourceLine, format string, args ...interface{}) Diagnostic {
+	return NewDiagnostic(line, Token{}, format, args...)
+}
+
+func (d Diagnostic) Error() string {
+	if d.Column == 0 {
+		return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+}
+
+/// Diagnostics is every error found while assembling a program, in source order within each pass
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Error() string {
+	messages := make([]string, len(d), len(d))
+	for i, diag := range d {
+		messages[i] = diag.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+/// @return d as an error, or nil if there are no diagnostics.
+///         Always use this rather than returning d directly, which would be a non-nil error even when empty.
+func (d Diagnostics) Err() error {
+	if len(d) == 0 {
+		return nil
+	}
+	return d
+}
+
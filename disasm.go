@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/// Disassemble writes the program as assembly source, which assembles back into an identical program.
+/// Jump targets are given synthetic labels, L followed by the instruction index.
+/// The ext before a jump whose target needs it is left out, since the assembler inserts it again.
+/// The machine in the header is written as a .machine directive, so the source assembles for it without flags.
+/// The data section is written as .init directives, before the instructions. Float data is written as float literals.
+///
+/// @return an error if an instruction can't be expressed in assembly, e.g. an invalid opcode,
+///         or bits set in fields the instruction doesn't use
+/// @param header the machine the program was compiled for, or nil for legacy files, whose data is integers
+func Disassemble(w io.Writer, program Program, header *ProgramHeader) error {
+	size := program.Size()
+	instructions := make([]ExecuteParam, size, size)
+	operands := make([][]string, size, size)
+	for i := range instructions {
+		instructions[i] = program.Decode(program.At(int64(i)))
+		var err error
+		operands[i], err = disassembleOperands(instructions[i])
+		if err != nil {
+			return fmt.Errorf("instruction %d: %s", i, err.Error())
+		}
+	}
+
+	isJump := func(i int) bool {
+		return jumpOperand(instructions[i].Op()) != -1
+	}
+	extended := func(i int) bool { // whether instruction i is a jump after an ext
+		return isJump(i) && i > 0 && instructions[i-1].Op() == isExt
+	}
+	jumpTarget := func(i int) int64 {
+		op := instructions[i].Op()
+		target := int64(instructions[i].Params()[jumpOperand(op)])
+		if extended(i) {
+			target |= int64(instructions[i-1].MemParam()) << program.OperandBits(op, jumpOperand(op))
+		}
+		return target
+	}
+	targets := make(map[int64]bool)
+	for i := range instructions {
+		if isJump(i) && jumpTarget(i) <= size {
+			targets[jumpTarget(i)] = true
+		}
+	}
+
+	// a label can't be written between an ext and its cmpx, nor can an ext be left out before a target which would fit without it
+	folded := make(map[int]bool) // the exts left out
+	for i := range instructions {
+		if !isJump(i) || jumpTarget(i) > size {
+			continue
+		}
+		op := instructions[i].Op()
+		if extended(i) {
+			if targets[int64(i)] || fitsBits(jumpTarget(i), program.OperandBits(op, jumpOperand(op))) {
+				continue
+			}
+			folded[i-1] = true
+		}
+		operands[i][jumpOperand(op)] = disasmLabel(jumpTarget(i))
+	}
+
+	if header != nil {
+		if _, err := fmt.Fprintf(w, ".machine arch=%s numpe=%d pemem=%d indexregisters=%d float=%t topology=%s\n",
+			header.Arch.String(), header.NumPE, header.PEMemory, header.IndexRegisters, header.Float(), header.Topology.String()); err != nil {
+			return err
+		}
+	}
+
+	for _, segment := range program.Data() {
+		values := make([]string, len(segment.Values), len(segment.Values))
+		for i, val := range segment.Values {
+			if header == nil || !header.Float() {
+				values[i] = strconv.FormatInt(val, 10)
+				continue
+			}
+			var err error
+			if values[i], err = floatLiteralString(val); err != nil {
+				return fmt.Errorf("data at %d: %s", segment.Address+i, err.Error())
+			}
+		}
+		if _, err := fmt.Fprintf(w, ".init %d = %s\n", segment.Address, strings.Join(values, ",")); err != nil {
+			return err
+		}
+	}
+
+	for i := int64(0); i <= size; i++ {
+		if targets[i] {
+			if _, err := fmt.Fprintf(w, "%s:\n", disasmLabel(i)); err != nil {
+				return err
+			}
+		}
+		if i == size || folded[int(i)] {
+			continue
+		}
+		line := instructions[i].Op().String()
+		if len(operands[i]) != 0 {
+			line += " " + strings.Join(operands[i], ",")
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/// @return the float64 data as a float literal, which always has a decimal point or exponent, so it isn't read as an integer, e.g. 3.0.
+///         Infinities and NaN have no literal, so are errors.
+func floatLiteralString(val int64) (string, error) {
+	f := math.Float64frombits(uint64(val))
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", fmt.Errorf("%v has no float literal", f)
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s, nil
+}
+
+/// @return the operands of the instruction, as they would be written in assembly
+func disassembleOperands(params ExecuteParam) ([]string, error) {
+	op := params.Op()
+	count, ok := InstructionParams[op]
+	if !ok {
+		return nil, fmt.Errorf("invalid opcode %d", op)
+	}
+
+	var values []int64
+	if params.IsMem() {
+		if isMemOnly(op) { // cload, cstore and ext have a memparam but no 1st param
+			if params.Param() != 0 {
+				return nil, fmt.Errorf("%s has unused param %d", op.String(), params.Param())
+			}
+			values = []int64{int64(params.MemParam())}
+		} else {
+			values = []int64{int64(params.Param()), int64(params.MemParam())}
+		}
+	} else {
+		for i, param := range params.Params() {
+			if i >= int(count) && param != 0 {
+				return nil, fmt.Errorf("%s has unused param %d", op.String(), param)
+			}
+			values = append(values, int64(param))
+		}
+		values = values[:count]
+	}
+
+	operands := make([]string, len(values), len(values))
+	for i, val := range values {
+		if InstructionOperand(op, i) == otRegister {
+			if !isRegister(val) {
+				return nil, fmt.Errorf("%s has invalid register %d", op.String(), val)
+			}
+			operands[i] = RegisterType(val).String()
+		} else if InstructionOperand(op, i) == otCondition {
+			if !isCondition(val) {
+				return nil, fmt.Errorf("%s has invalid condition %d", op.String(), val)
+			}
+			operands[i] = Condition(val).String()
+		} else if InstructionOperand(op, i) == otDirection {
+			if !isDirection(val) {
+				return nil, fmt.Errorf("%s has invalid direction %d", op.String(), val)
+			}
+			operands[i] = Direction(val).String()
+		} else if InstructionOperand(op, i) == otReduction {
+			if !isReduction(val) {
+				return nil, fmt.Errorf("%s has invalid reduction %d", op.String(), val)
+			}
+			operands[i] = Reduction(val).String()
+		} else {
+			operands[i] = strconv.FormatInt(val, 10)
+		}
+	}
+	return operands, nil
+}
+
+/// @return the synthetic label for the given instruction index
+func disasmLabel(index int64) string {
+	return "L" + strconv.FormatInt(index, 10)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/// SymbolLookup returns the value of the named symbol, e.g. an alias or label, and whether it exists.
+/// The name is lower case.
+type SymbolLookup func(name string) (value int64, ok bool)
+
+/// Evaluates a constant expression, in operands and pseudo-op values.
+///
+/// Expressions are made of numbers (decimal, or hex with 0x), symbols, parentheses,
+/// unary + and -, and the binary operators below, from lowest to highest precedence:
+///
+///     |
+///     &
+///     << >>
+///     + -
+///     * / %
+///
+/// @param expr the expression, and the column it starts at in line
+func EvaluateExpression(line SourceLine, expr Token, symbols SymbolLookup) (int64, *Diagnostic) {
+	tokens, diag := tokenizeExpression(line, expr, false)
+	if diag != nil {
+		return 0, diag
+	}
+	return evaluateTokens(line, expr, tokens, symbols)
+}
+
+/// Evaluates a WIDTHxHEIGHT dimension, e.g. `3x3` or `n x n+1`, for bss pseudo-ops.
+func EvaluateDimension(line SourceLine, expr Token, symbols SymbolLookup) (width int64, height int64, diag *Diagnostic) {
+	tokens, diag := tokenizeExpression(line, expr, true)
+	if diag != nil {
+		return 0, 0, diag
+	}
+	separator := -1
+	for i, token := range tokens {
+		if token.Text == "x" {
+			if separator != -1 {
+				diag := NewDiagnostic(line, token, "unexpected 'x' in dimension '%s', expected WIDTHxHEIGHT", expr.Text)
+				return 0, 0, &diag
+			}
+			separator = i
+		}
+	}
+	if separator == -1 {
+		diag := NewDiagnostic(line, expr, "invalid dimension '%s', expected WIDTHxHEIGHT", expr.Text)
+		return 0, 0, &diag
+	}
+	width, diag = evaluateTokens(line, expr, tokens[:separator], symbols)
+	if diag != nil {
+		return 0, 0, diag
+	}
+	height, diag = evaluateTokens(line, expr, tokens[separator+1:], symbols)
+	return width, height, diag
+}
+
+/// @param dimension whether to split `3x3` into `3`, `x`, `3` rather than reading `0x3` as hex
+func tokenizeExpression(line SourceLine, expr Token, dimension bool) (tokens []Token, diag *Diagnostic) {
+	text := expr.Text
+	for i := 0; i < len(text); {
+		r := rune(text[i])
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case unicode.IsDigit(r):
+			if !dimension && (strings.HasPrefix(text[i:], "0x") || strings.HasPrefix(text[i:], "0X")) {
+				i += 2
+			}
+			for i < len(text) && isExpressionWordChar(rune(text[i])) && !(dimension && (text[i] == 'x' || text[i] == 'X')) {
+				i++
+			}
+		case isExpressionWordChar(r):
+			for i < len(text) && isExpressionWordChar(rune(text[i])) {
+				i++
+			}
+		case strings.HasPrefix(text[i:], "<<") || strings.HasPrefix(text[i:], ">>"):
+			i += 2
+		case strings.ContainsRune("+-*/%&|()", r):
+			i++
+		default:
+			diag := NewDiagnostic(line, Token{text[i : i+1], expr.Column + i}, "unexpected '%c' in expression", r)
+			return nil, &diag
+		}
+		word := text[start:i]
+		if dimension && (word == "x" || word == "X") {
+			word = "x"
+		} else if dimension && i < len(text) && (text[i] == 'x' || text[i] == 'X') && unicode.IsDigit(r) {
+			tokens = append(tokens, Token{word, expr.Column + start})
+			word, start = "x", i
+			i++
+		}
+		tokens = append(tokens, Token{word, expr.Column + start})
+	}
+	return tokens, nil
+}
+
+func isExpressionWordChar(r rune) bool {
+	return r == '_' || r == '@' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func evaluateTokens(line SourceLine, expr Token, tokens []Token, symbols SymbolLookup) (int64, *Diagnostic) {
+	p := expressionParser{line: line, expr: expr, tokens: tokens, symbols: symbols}
+	val := p.parseBinary(0)
+	if p.diag == nil && p.pos < len(p.tokens) {
+		p.fail(p.tokens[p.pos], "unexpected '%s' in expression", p.tokens[p.pos].Text)
+	}
+	return val, p.diag
+}
+
+/// binary operators, by precedence level, lowest first
+var binaryOperators = [][]string{
+	{"|"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+/// a recursive descent parser, which evaluates as it parses
+type expressionParser struct {
+	line    SourceLine
+	expr    Token
+	tokens  []Token
+	pos     int
+	symbols SymbolLookup
+	diag    *Diagnostic ///< the first error. Parsing continues after an error, but the result is meaningless.
+}
+
+func (p *expressionParser) fail(token Token, format string, args ...interface{}) {
+	if p.diag == nil {
+		diag := NewDiagnostic(p.line, token, format, args...)
+		p.diag = &diag
+	}
+}
+
+/// @return the next token, or an empty token at the end of the expression
+func (p *expressionParser) peek() Token {
+	if p.pos >= len(p.tokens) {
+		return Token{"", p.expr.Column + len(p.expr.Text)}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *expressionParser) parseBinary(level int) int64 {
+	if level == len(binaryOperators) {
+		return p.parseUnary()
+	}
+	left := p.parseBinary(level + 1)
+	for {
+		op := p.peek()
+		if !containsString(binaryOperators[level], op.Text) {
+			return left
+		}
+		p.pos++
+		right := p.parseBinary(level + 1)
+		left = p.apply(op, left, right)
+	}
+}
+
+func (p *expressionParser) apply(op Token, left int64, right int64) int64 {
+	switch op.Text {
+	case "|":
+		return left | right
+	case "&":
+		return left & right
+	case "<<", ">>":
+		if right < 0 || right > 63 {
+			p.fail(op, "shift by %d is out of range", right)
+			return 0
+		}
+		if op.Text == "<<" {
+			return left << uint(right)
+		}
+		return left >> uint(right)
+	case "+":
+		return left + right
+	case "-":
+		return left - right
+	case "*":
+		return left * right
+	case "/", "%":
+		if right == 0 {
+			p.fail(op, "division by zero")
+			return 0
+		}
+		if op.Text == "/" {
+			return left / right
+		}
+		return left % right
+	}
+	return 0
+}
+
+func (p *expressionParser) parseUnary() int64 {
+	token := p.peek()
+	switch token.Text {
+	case "-":
+		p.pos++
+		return -p.parseUnary()
+	case "+":
+		p.pos++
+		return p.parseUnary()
+	}
+	return p.parsePrimary()
+}
+
+func (p *expressionParser) parsePrimary() int64 {
+	token := p.peek()
+	switch {
+	case token.Text == "":
+		p.fail(token, "missing value at end of expression '%s'", p.expr.Text)
+		return 0
+	case token.Text == "(":
+		p.pos++
+		val := p.parseBinary(0)
+		if p.peek().Text != ")" {
+			p.fail(token, "unbalanced '(' in expression")
+			return val
+		}
+		p.pos++
+		return val
+	case unicode.IsDigit(rune(token.Text[0])):
+		p.pos++
+		var val int64
+		var err error
+		if hex := strings.ToLower(token.Text); strings.HasPrefix(hex, "0x") {
+			val, err = strconv.ParseInt(hex[2:], 16, 64)
+		} else {
+			val, err = strconv.ParseInt(token.Text, 10, 64)
+		}
+		if err != nil {
+			p.fail(token, "invalid number '%s'", token.Text)
+		}
+		return val
+	case isIdentifier(token.Text):
+		p.pos++
+		val, ok := p.symbols(strings.ToLower(token.Text))
+		if !ok {
+			p.fail(token, "undefined symbol '%s'", token.Text)
+		}
+		return val
+	}
+	p.fail(token, "unexpected '%s' in expression", token.Text)
+	return 0
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
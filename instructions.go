@@ -3,6 +3,12 @@
 ///
 package main
 
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
 type RegisterType int64
 
 const (
@@ -11,6 +17,347 @@ const (
 	peArithmetic
 )
 
+const isInvalidRegister = RegisterType(-1)
+
+/// @return the PE register with the given name, e.g. ar or arithmetic
+func StringToRegister(s string) RegisterType {
+	switch s {
+	case "ix", "index":
+		return peIndex
+	case "rr", "routing":
+		return peRouting
+	case "ar", "arithmetic":
+		return peArithmetic
+	}
+	return isInvalidRegister
+}
+
+/// @return the PE register named by a single letter, as in mov shorthands like `movA toR`
+func letterToRegister(s string) RegisterType {
+	switch s {
+	case "i", "x":
+		return peIndex
+	case "r":
+		return peRouting
+	case "a":
+		return peArithmetic
+	}
+	return isInvalidRegister
+}
+
+func (r RegisterType) String() string {
+	switch r {
+	case peIndex:
+		return "ix"
+	case peRouting:
+		return "rr"
+	case peArithmetic:
+		return "ar"
+	}
+	return "NUL"
+}
+
+func isRegister(r int64) bool {
+	return r == peIndex || r == peRouting || r == peArithmetic
+}
+
+/// Condition is how a compare instruction compares two values, e.g. the condition of vcmp
+type Condition int64
+
+const (
+	condLt Condition = iota
+	condEq
+	condNe
+	condLe
+	condGt
+	condGe
+)
+
+const isInvalidCondition = Condition(-1)
+
+/// @return the condition with the given name, e.g. lt
+func StringToCondition(s string) Condition {
+	switch s {
+	case "lt":
+		return condLt
+	case "eq":
+		return condEq
+	case "ne":
+		return condNe
+	case "le":
+		return condLe
+	case "gt":
+		return condGt
+	case "ge":
+		return condGe
+	}
+	return isInvalidCondition
+}
+
+func (c Condition) String() string {
+	switch c {
+	case condLt:
+		return "lt"
+	case condEq:
+		return "eq"
+	case condNe:
+		return "ne"
+	case condLe:
+		return "le"
+	case condGt:
+		return "gt"
+	case condGe:
+		return "ge"
+	}
+	return "NUL"
+}
+
+func isCondition(c int64) bool {
+	return c >= int64(condLt) && c <= int64(condGe)
+}
+
+/// @return whether x compares to y by the condition, e.g. x < y for lt
+func (c Condition) Holds(x int64, y int64) bool {
+	switch c {
+	case condLt:
+		return x < y
+	case condEq:
+		return x == y
+	case condNe:
+		return x != y
+	case condLe:
+		return x <= y
+	case condGt:
+		return x > y
+	case condGe:
+		return x >= y
+	}
+	return false
+}
+
+/// @return whether x compares to y by the condition. Every condition is false when either is NaN, except ne, which is true.
+func (c Condition) HoldsFloat(x float64, y float64) bool {
+	switch c {
+	case condLt:
+		return x < y
+	case condEq:
+		return x == y
+	case condNe:
+		return x != y
+	case condLe:
+		return x <= y
+	case condGt:
+		return x > y
+	case condGe:
+		return x >= y
+	}
+	return false
+}
+
+/// Reduction is how the reduce instruction combines the ARs of the enabled PEs
+type Reduction int64
+
+const (
+	redSum Reduction = iota
+	redProd
+	redMin
+	redMax
+	redAnd   ///< bitwise
+	redOr    ///< bitwise
+	redCount ///< the number of enabled PEs, rather than a combination of their ARs
+)
+
+const isInvalidReduction = Reduction(-1)
+
+/// @return the reduction with the given name, e.g. sum
+func StringToReduction(s string) Reduction {
+	switch s {
+	case "sum":
+		return redSum
+	case "prod":
+		return redProd
+	case "min":
+		return redMin
+	case "max":
+		return redMax
+	case "and":
+		return redAnd
+	case "or":
+		return redOr
+	case "count":
+		return redCount
+	}
+	return isInvalidReduction
+}
+
+func (r Reduction) String() string {
+	switch r {
+	case redSum:
+		return "sum"
+	case redProd:
+		return "prod"
+	case redMin:
+		return "min"
+	case redMax:
+		return "max"
+	case redAnd:
+		return "and"
+	case redOr:
+		return "or"
+	case redCount:
+		return "count"
+	}
+	return "NUL"
+}
+
+func isReduction(r int64) bool {
+	return r >= int64(redSum) && r <= int64(redCount)
+}
+
+/// @return the result of reducing no values, which combined with x is x, e.g. 0 for sum, as int64 or float64 data.
+///         The min of nothing is the largest value, and the max the smallest, which for floats are +Inf and -Inf.
+func (r Reduction) Identity(float bool) int64 {
+	switch r {
+	case redProd:
+		return toData(1, float)
+	case redMin:
+		if float {
+			return int64(math.Float64bits(math.Inf(1)))
+		}
+		return math.MaxInt64
+	case redMax:
+		if float {
+			return int64(math.Float64bits(math.Inf(-1)))
+		}
+		return math.MinInt64
+	case redAnd:
+		return ^0
+	}
+	return 0 // +0.0 for floats
+}
+
+/// @return x and y combined by the reduction, e.g. x + y for sum, as int64 or float64 data. Counts are combined by adding them.
+///         The float min and max of NaN and anything is NaN, even infinities, so a NaN in any PE carries through. Bitwise and and or use the bits of floats.
+func (r Reduction) Combine(x int64, y int64, float bool) int64 {
+	switch r {
+	case redSum, redCount:
+		return arithmetic(isAdd, x, y, float)
+	case redProd:
+		return arithmetic(isMul, x, y, float)
+	case redMin, redMax:
+		if float {
+			fx, fy := math.Float64frombits(uint64(x)), math.Float64frombits(uint64(y))
+			if math.IsNaN(fx) {
+				return x
+			}
+			if math.IsNaN(fy) {
+				return y
+			}
+			if r == redMin {
+				return int64(math.Float64bits(math.Min(fx, fy)))
+			}
+			return int64(math.Float64bits(math.Max(fx, fy)))
+		}
+		if (r == redMin) == (x < y) {
+			return x
+		}
+		return y
+	case redAnd:
+		return x & y
+	case redOr:
+		return x | y
+	}
+	return x
+}
+
+/// @return the integer as int64 or float64 data
+func toData(v int64, float bool) int64 {
+	if float {
+		return int64(math.Float64bits(float64(v)))
+	}
+	return v
+}
+
+/// @return the int64 or float64 data as an integer. Floats are truncated toward zero,
+///         those too large for an int64, including infinities, are the largest or smallest int64, and NaN is 0.
+func fromData(v int64, float bool) int64 {
+	if !float {
+		return v
+	}
+	f := math.Float64frombits(uint64(v))
+	switch {
+	case math.IsNaN(f):
+		return 0
+	case f >= math.MaxInt64:
+		return math.MaxInt64
+	case f <= math.MinInt64:
+		return math.MinInt64
+	}
+	return int64(f)
+}
+
+/// Direction is which way a routing instruction, like shift, moves data across the PEs.
+/// Which directions a machine has depends on its Topology.
+type Direction int64
+
+const (
+	dirRight Direction = iota ///< toward higher-numbered PEs
+	dirLeft                   ///< toward lower-numbered PEs
+	dirDown                   ///< to the next row of a mesh
+	dirUp                     ///< to the previous row of a mesh
+	dirDim0                   ///< across the lowest dimension of a hypercube. Higher dimensions follow, e.g. dirDim0+1 is dim1.
+)
+
+const isInvalidDirection = Direction(-1)
+
+/// @return the direction with the given name, e.g. right
+func StringToDirection(s string) Direction {
+	switch s {
+	case "right":
+		return dirRight
+	case "left":
+		return dirLeft
+	case "down":
+		return dirDown
+	case "up":
+		return dirUp
+	}
+	if dim, err := strconv.ParseUint(strings.TrimPrefix(s, "dim"), 10, 8); strings.HasPrefix(s, "dim") && err == nil {
+		return dirDim0 + Direction(dim)
+	}
+	return isInvalidDirection
+}
+
+func (d Direction) String() string {
+	switch d {
+	case dirRight:
+		return "right"
+	case dirLeft:
+		return "left"
+	case dirDown:
+		return "down"
+	case dirUp:
+		return "up"
+	}
+	if d >= dirDim0 {
+		return "dim" + strconv.FormatInt(int64(d-dirDim0), 10)
+	}
+	return "NUL"
+}
+
+func isDirection(d int64) bool {
+	return d >= int64(dirRight)
+}
+
+/// @return the source register of a mov shorthand like `movA toR`, and whether the mnemonic is one
+func movShorthand(mnemonic string) (RegisterType, bool) {
+	if !strings.HasPrefix(mnemonic, "mov") || len(mnemonic) != len("mov")+1 {
+		return isInvalidRegister, false
+	}
+	r := letterToRegister(mnemonic[len("mov"):])
+	return r, r != isInvalidRegister
+}
+
 type ByteTuple struct {
 	First  byte
 	Second byte
@@ -43,6 +390,47 @@ const (
 	isRsub
 	isRmul
 	isRdiv
+	isExt ///< extends the jump target of the next instruction with high bits. Inserted by the assembler for long jumps.
+	isJmp
+	isCall
+	isRet
+	isCmpxEq ///< cmpx compares an index register to another with <, these with the other conditions
+	isCmpxNe
+	isCmpxLe
+	isCmpxGt
+	isCmpxGe
+	isCmpxi ///< compares an index register to an immediate value
+	isCmpxEqi
+	isCmpxNei
+	isCmpxLei
+	isCmpxGti
+	isCmpxGei
+	isVcmp ///< sets each PE's enable bit by comparing its AR to memory
+	isRcmp ///< sets each PE's enable bit by comparing its AR to its RR
+	isZcmp ///< sets each PE's enable bit by comparing its AR to zero
+	isMload
+	isMstore
+	isEnable
+	isVif ///< pushes the enable bits, so the compares which follow only enable PEs enabled now
+	isVelse
+	isVendif
+	isAnd ///< bitwise and shift instructions, on AR and memory
+	isOr
+	isXor
+	isNot
+	isShl
+	isShr  ///< shifts in zeros
+	isSar  ///< shifts in copies of the sign bit
+	isRand ///< bitwise and shift instructions, on AR and RR
+	isRor
+	isRxor
+	isRnot
+	isRshl
+	isRshr
+	isRsar
+	isShift  ///< moves each PE's RR to another PE's, leaving zero in the PEs nothing moves into
+	isRotate ///< moves each PE's RR to another PE's, wrapping around the ends
+	isReduce ///< combines the ARs of the enabled PEs into the CU's AR
 
 	isInvalid OpCode = ^OpCode(0)
 )
@@ -65,8 +453,82 @@ func StringToInstruction(s string) OpCode {
 		return isCload
 	case "cstore":
 		return isCstore
-	case "cmpx":
+	case "cmpx", "cmpxlt":
 		return isCmpx
+	case "cmpxeq":
+		return isCmpxEq
+	case "cmpxne":
+		return isCmpxNe
+	case "cmpxle":
+		return isCmpxLe
+	case "cmpxgt":
+		return isCmpxGt
+	case "cmpxge":
+		return isCmpxGe
+	case "cmpxi", "cmpxlti":
+		return isCmpxi
+	case "cmpxeqi":
+		return isCmpxEqi
+	case "cmpxnei":
+		return isCmpxNei
+	case "cmpxlei":
+		return isCmpxLei
+	case "cmpxgti":
+		return isCmpxGti
+	case "cmpxgei":
+		return isCmpxGei
+	case "vcmp":
+		return isVcmp
+	case "shift":
+		return isShift
+	case "rotate":
+		return isRotate
+	case "reduce":
+		return isReduce
+	case "rcmp":
+		return isRcmp
+	case "zcmp":
+		return isZcmp
+	case "mload":
+		return isMload
+	case "mstore":
+		return isMstore
+	case "enable":
+		return isEnable
+	case "vif":
+		return isVif
+	case "velse":
+		return isVelse
+	case "vendif":
+		return isVendif
+	case "and":
+		return isAnd
+	case "or":
+		return isOr
+	case "xor":
+		return isXor
+	case "not":
+		return isNot
+	case "shl":
+		return isShl
+	case "shr":
+		return isShr
+	case "sar":
+		return isSar
+	case "rand":
+		return isRand
+	case "ror":
+		return isRor
+	case "rxor":
+		return isRxor
+	case "rnot":
+		return isRnot
+	case "rshl":
+		return isRshl
+	case "rshr":
+		return isRshr
+	case "rsar":
+		return isRsar
 	case "cbcast":
 		return isCbcast
 	case "lod":
@@ -88,11 +550,19 @@ func StringToInstruction(s string) OpCode {
 	case "radd":
 		return isRadd
 	case "rsub":
-		return isSub
+		return isRsub
 	case "rmul":
 		return isRmul
 	case "rdiv":
 		return isRdiv
+	case "ext":
+		return isExt
+	case "jmp":
+		return isJmp
+	case "call":
+		return isCall
+	case "ret":
+		return isRet
 	}
 	return isInvalid
 }
@@ -143,36 +613,300 @@ func (i OpCode) String() string {
 		return "rmul"
 	case isRdiv:
 		return "rdiv"
+	case isExt:
+		return "ext"
+	case isJmp:
+		return "jmp"
+	case isCall:
+		return "call"
+	case isRet:
+		return "ret"
+	case isCmpxEq:
+		return "cmpxeq"
+	case isCmpxNe:
+		return "cmpxne"
+	case isCmpxLe:
+		return "cmpxle"
+	case isCmpxGt:
+		return "cmpxgt"
+	case isCmpxGe:
+		return "cmpxge"
+	case isCmpxi:
+		return "cmpxi"
+	case isCmpxEqi:
+		return "cmpxeqi"
+	case isCmpxNei:
+		return "cmpxnei"
+	case isCmpxLei:
+		return "cmpxlei"
+	case isCmpxGti:
+		return "cmpxgti"
+	case isCmpxGei:
+		return "cmpxgei"
+	case isVcmp:
+		return "vcmp"
+	case isRcmp:
+		return "rcmp"
+	case isZcmp:
+		return "zcmp"
+	case isMload:
+		return "mload"
+	case isMstore:
+		return "mstore"
+	case isEnable:
+		return "enable"
+	case isVif:
+		return "vif"
+	case isVelse:
+		return "velse"
+	case isVendif:
+		return "vendif"
+	case isAnd:
+		return "and"
+	case isOr:
+		return "or"
+	case isXor:
+		return "xor"
+	case isNot:
+		return "not"
+	case isShl:
+		return "shl"
+	case isShr:
+		return "shr"
+	case isSar:
+		return "sar"
+	case isRand:
+		return "rand"
+	case isRor:
+		return "ror"
+	case isRxor:
+		return "rxor"
+	case isRnot:
+		return "rnot"
+	case isRshl:
+		return "rshl"
+	case isRshr:
+		return "rshr"
+	case isRsar:
+		return "rsar"
+	case isShift:
+		return "shift"
+	case isRotate:
+		return "rotate"
+	case isReduce:
+		return "reduce"
 	}
 	return "NUL"
 }
 
+/// OperandType is the kind of value an instruction operand holds
+type OperandType int
+
+const (
+	otValue     OperandType = iota ///< a number, such as an index register, memory address, or jump target
+	otRegister                     ///< a PE register, named ar, rr or ix, or numbered
+	otCondition                    ///< a Condition, named lt, eq, ne, le, gt or ge
+	otDirection                    ///< a Direction, like right or dim0
+	otReduction                    ///< a Reduction, named sum, prod, min, max, and, or or count
+)
+
+/// @return the type of the given operand of the instruction
+func InstructionOperand(op OpCode, operand int) OperandType {
+	if op == isMov {
+		return otRegister
+	}
+	if (op == isVcmp || op == isRcmp || op == isZcmp) && operand == 0 {
+		return otCondition
+	}
+	if (op == isShift || op == isRotate) && operand == 0 {
+		return otDirection
+	}
+	if op == isReduce {
+		return otReduction
+	}
+	return otValue
+}
+
+/// @return what the given operand of the instruction is, for diagnostics
+func OperandName(op OpCode, operand int) string {
+	switch {
+	case op == isMov:
+		return "register"
+	case InstructionOperand(op, operand) == otCondition:
+		return "condition"
+	case InstructionOperand(op, operand) == otDirection:
+		return "direction"
+	case InstructionOperand(op, operand) == otReduction:
+		return "reduction"
+	case isJumpTarget(op, operand):
+		return "jump target"
+	case isCompareImmediate(op) && operand == 1:
+		return "immediate value"
+	case op == isExt:
+		return "jump extension"
+	case op == isCload || op == isCstore || op == isMload || op == isMstore:
+		return "CU memory address"
+	case (op == isLdx || op == isStx) && operand == 1:
+		return "CU memory address"
+	case isMem(op) && operand == 1:
+		return "immediate value"
+	case op == isLod || op == isSto || op == isAdd || op == isSub || op == isMul || op == isDiv || isLogic(op):
+		if operand == 0 {
+			return "PE memory address"
+		}
+	case op == isVcmp:
+		if operand == 1 {
+			return "PE memory address"
+		}
+	}
+	return "index register"
+}
+
 var InstructionParams = map[OpCode]byte{
-	isLdx:    2,
-	isStx:    2,
-	isLdxi:   2,
-	isIncx:   2,
-	isDecx:   2,
-	isMulx:   2,
-	isCload:  1,
-	isCstore: 1,
-	isCmpx:   3,
-	isCbcast: 0,
-	isLod:    2,
-	isSto:    2,
-	isAdd:    2,
-	isSub:    2,
-	isMul:    2,
-	isDiv:    2,
-	isBcast:  1,
-	isMov:    2,
-	isRadd:   0,
-	isRsub:   0,
-	isRmul:   0,
-	isRdiv:   0,
+	isLdx:     2,
+	isStx:     2,
+	isLdxi:    2,
+	isIncx:    2,
+	isDecx:    2,
+	isMulx:    2,
+	isCload:   1,
+	isCstore:  1,
+	isCmpx:    3,
+	isCbcast:  0,
+	isLod:     2,
+	isSto:     2,
+	isAdd:     2,
+	isSub:     2,
+	isMul:     2,
+	isDiv:     2,
+	isBcast:   1,
+	isMov:     2,
+	isRadd:    0,
+	isRsub:    0,
+	isRmul:    0,
+	isRdiv:    0,
+	isExt:     1,
+	isJmp:     1,
+	isCall:    1,
+	isRet:     0,
+	isCmpxEq:  3,
+	isCmpxNe:  3,
+	isCmpxLe:  3,
+	isCmpxGt:  3,
+	isCmpxGe:  3,
+	isCmpxi:   3,
+	isCmpxEqi: 3,
+	isCmpxNei: 3,
+	isCmpxLei: 3,
+	isCmpxGti: 3,
+	isCmpxGei: 3,
+	isVcmp:    3,
+	isRcmp:    1,
+	isZcmp:    1,
+	isMload:   1,
+	isMstore:  1,
+	isEnable:  0,
+	isVif:     0,
+	isVelse:   0,
+	isVendif:  0,
+	isAnd:     2,
+	isOr:      2,
+	isXor:     2,
+	isNot:     2,
+	isShl:     2,
+	isShr:     2,
+	isSar:     2,
+	isRand:    0,
+	isRor:     0,
+	isRxor:    0,
+	isRnot:    0,
+	isRshl:    0,
+	isRshr:    0,
+	isRsar:    0,
+	isShift:   2,
+	isRotate:  2,
+	isReduce:  1,
+}
+
+/// @return which operand of the instruction is the instruction index to jump to, or -1 if it doesn't jump to an operand
+func jumpOperand(op OpCode) int {
+	switch {
+	case isCompare(op):
+		return 2
+	case op == isJmp || op == isCall:
+		return 0
+	}
+	return -1
+}
+
+/// @return whether the given operand of the instruction is an instruction index to jump to.
+///         Jump targets which don't fit in their field are extended by an ext instruction before the jump.
+func isJumpTarget(op OpCode, operand int) bool {
+	return operand == jumpOperand(op) && operand != -1
+}
+
+/// @return whether the instruction is a compare-and-branch, cmpx or one of its other conditions
+func isCompare(op OpCode) bool {
+	return op == isCmpx || (op >= isCmpxEq && op <= isCmpxGei)
+}
+
+/// @return whether the compare-and-branch instruction compares to an immediate value, rather than an index register
+func isCompareImmediate(op OpCode) bool {
+	return op >= isCmpxi && op <= isCmpxGei
+}
+
+/// @return the condition on which the compare-and-branch instruction branches
+func branchCondition(op OpCode) Condition {
+	switch op {
+	case isCmpx, isCmpxi:
+		return condLt
+	case isCmpxEq, isCmpxEqi:
+		return condEq
+	case isCmpxNe, isCmpxNei:
+		return condNe
+	case isCmpxLe, isCmpxLei:
+		return condLe
+	case isCmpxGt, isCmpxGti:
+		return condGt
+	case isCmpxGe, isCmpxGei:
+		return condGe
+	}
+	return isInvalidCondition
+}
+
+/// @return whether the instruction is a bitwise or shift instruction on AR and memory, like and
+func isLogic(op OpCode) bool {
+	return op >= isAnd && op <= isSar
+}
+
+/// @return the result of the bitwise or shift instruction on x and y, e.g. x & y for and and rand.
+///         Shifting by a negative amount, or by 64 or more, shifts out every bit.
+func logic(op OpCode, x int64, y int64) int64 {
+	switch op {
+	case isAnd, isRand:
+		return x & y
+	case isOr, isRor:
+		return x | y
+	case isXor, isRxor:
+		return x ^ y
+	case isNot, isRnot:
+		return ^y
+	case isShl, isRshl:
+		return x << uint64(y)
+	case isShr, isRshr:
+		return int64(uint64(x) >> uint64(y))
+	case isSar, isRsar:
+		return x >> uint64(y)
+	}
+	return x
+}
+
+/// @return whether the given CU Memory instruction has only a memparam, and no 1st param
+func isMemOnly(i OpCode) bool {
+	return i == isCload || i == isCstore || i == isExt || i == isMload || i == isMstore
 }
 
 /// @return whether the given instruction is a CU Memory instruction, i.e. using a 12-bit memory address
 func isMem(i OpCode) bool {
-	return (i == isLdx || i == isStx || i == isCload || i == isCstore || i == isLdxi || i == isIncx || i == isDecx || i == isMulx)
+	return (i == isLdx || i == isStx || i == isCload || i == isCstore || i == isLdxi || i == isIncx || i == isDecx || i == isMulx || i == isExt || i == isMload || i == isMstore)
 }
@@ -1,41 +1,66 @@
 package main
 
 import (
-	"errors"
-	//	"fmt"
+	"fmt"
+	"math"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
+/// Token is a piece of a source line, and the column it starts at
+type Token struct {
+	Text   string
+	Column int ///< 1-based
+}
+
+/// SourceLine is a line of assembly, and where it came from
+type SourceLine struct {
+	File   string
+	Number int    ///< 1-based line number in File
+	Text   string ///< the line as written
+	Code   string ///< the part of the line still to be parsed. Parsed text is blanked rather than removed, so columns still match Text
+
+	Expansion *SourceLine ///< the macro invocation this line was expanded from, if any. File and Number are then the line in the macro body.
+}
+
 /// NOTE Programs must be run on the same CU they are compiled for.
 ///      That is, with the same registers, elements, and memory.
 ///      Otherwise, memory layouts will not line up and the program will explode.
-func LexProgram(cu *ControlUnitData, source string, program Program) error {
-	lines := RemoveBlanks(strings.Split(source, "\n"))
-	lines, err := ParsePseudoOperations(cu, lines, program)
-	if err != nil {
-		return err
-	}
-	lines, labels := ParseLabels(lines)
-	return ReplaceLabels(lines, labels, program)
-
-	//	input := strings.Join(lines, "\n") // debug
-	//	fmt.Println("ppo input: X" + input + "X")
-
-	//	output := strings.Join(lines, "\n")         // debug
-	//	fmt.Println("ppo output: X" + output + "X") // debug
+///      Saved programs have a header with the CU config, which is checked before running them.
+///
+/// @param file the name of the source file, used in diagnostics
+/// @return Diagnostics for every error in the source, or nil
+func LexProgram(cu *ControlUnitData, file string, source string, program Program) error {
+	return NewAssembler(cu, program).Assemble(file, source)
+}
 
-	//	output = strings.Join(lines, "\n")         // debug
-	//	fmt.Println("pl output: X" + output + "X") // debug
+func SplitLines(file string, source string) []SourceLine {
+	var lines []SourceLine
+	for i, text := range strings.Split(source, "\n") {
+		text = strings.TrimRight(text, "\r")
+		lines = append(lines, SourceLine{File: file, Number: i + 1, Text: text, Code: StripComment(text)})
+	}
+	return lines
+}
 
-	//	fmt.Print("Labels: ")
-	//	fmt.Println(labels)
+/// Comments begin with ';' or '#' and run to the end of the line. Quoted strings may contain either.
+func StripComment(line string) string {
+	quoted := false
+	for i, r := range line {
+		switch {
+		case r == '"' && (i == 0 || line[i-1] != '\\'):
+			quoted = !quoted
+		case (r == ';' || r == '#') && !quoted:
+			return line[:i]
+		}
+	}
+	return line
 }
 
-func RemoveBlanks(lines []string) []string {
+func RemoveBlanks(lines []SourceLine) []SourceLine {
 	for i := 0; i < len(lines); i++ {
-		lines[i] = strings.TrimSpace(lines[i])
-		if len(lines[i]) == 0 {
+		if len(strings.TrimSpace(lines[i].Code)) == 0 {
 			lines = append(lines[:i], lines[i+1:]...)
 			i--
 		}
@@ -43,50 +68,127 @@ func RemoveBlanks(lines []string) []string {
 	return lines
 }
 
-/// @todo handle movR toA etc.
-func ReplaceLabels(lines []string, labels map[string]int, program Program) error {
-	//	instructionSize := 3 ///< @todo don't hardcode instruction size here. Magic numbers bad!
-	realLabels := make(map[string]int)
-	for i, _ := range lines {
-		for key, val := range labels {
-			if val == i {
-				realLabels[key] = int(program.Size()) + i
-				//				fmt.Printf("RealLabel %s is %d + %d + %d = %d\n", key, program.Size(), i, instructionSize, realLabels[key])
+/// @return the whitespace-separated fields of the line's remaining code
+func (l SourceLine) Fields() []Token {
+	var tokens []Token
+	start := -1
+	for i, r := range l.Code {
+		if unicode.IsSpace(r) {
+			if start != -1 {
+				tokens = append(tokens, Token{l.Code[start:i], start + 1})
+				start = -1
 			}
+		} else if start == -1 {
+			start = i
 		}
 	}
-	for i, _ := range lines {
-		var params []int
+	if start != -1 {
+		tokens = append(tokens, Token{l.Code[start:], start + 1})
+	}
+	return tokens
+}
+
+/// @return the comma-separated operands following the given token, e.g. the mnemonic.
+///         Operands may contain spaces, e.g. `lod c + 1, i`.
+///         An operand missing between commas is returned as an empty token.
+func (l SourceLine) Operands(after Token) []Token {
+	offset := after.Column - 1 + len(after.Text)
+	text := l.Code[offset:]
+	if len(strings.TrimSpace(text)) == 0 {
+		return nil
+	}
+
+	var operands []Token
+	for _, piece := range strings.Split(text, ",") {
+		operands = append(operands, trimToken(Token{piece, offset + 1}))
+		offset += len(piece) + 1
+	}
+	return operands
+}
+
+/// @return the token without surrounding whitespace, and its column adjusted to match
+func trimToken(t Token) Token {
+	trimmed := strings.TrimLeftFunc(t.Text, unicode.IsSpace)
+	column := t.Column + len(t.Text) - len(trimmed)
+	return Token{strings.TrimRightFunc(trimmed, unicode.IsSpace), column}
+}
+
+/// @return the rest of the line's code following the given token, without surrounding whitespace
+func (l SourceLine) Rest(after Token) Token {
+	offset := after.Column - 1 + len(after.Text)
+	return trimToken(Token{l.Code[offset:], offset + 1})
+}
 
-		tokens := strings.Fields(lines[i])
+/// Assembles the given instructions into the program, evaluating their operands with the symbols
+/// @param network the PE network, whose directions routing instructions may use
+/// @param listing records the source line of each instruction. May be nil.
+func ReplaceLabels(lines []SourceLine, long []bool, symbols SymbolLookup, program Program, network Network, listing *Listing) Diagnostics {
+	var diags Diagnostics
+	for lineIndex, line := range lines {
+		tokens := line.Fields()
 		if len(tokens) == 0 {
-			return errors.New("malformed line a " + strconv.Itoa(i))
+			continue
 		}
 
-		op := StringToInstruction(strings.ToLower(tokens[0]))
+		mnemonic := tokens[0]
+		op := StringToInstruction(strings.ToLower(mnemonic.Text))
+		operands := line.Operands(mnemonic)
+		if from, ok := movShorthand(strings.ToLower(mnemonic.Text)); ok && op == isInvalid {
+			op = isMov
+			operands = expandMovShorthand(from, mnemonic, operands)
+		}
 		if op == isInvalid {
-			return errors.New("malformed line b " + strconv.Itoa(i))
-		}
-
-		tokens = tokens[1:]
-		for j, _ := range tokens {
-
-			subtokens := strings.Split(tokens[j], ",")
-			for k, _ := range subtokens {
-				subtokens[k] = strings.ToLower(subtokens[k])
-				for key, val := range realLabels {
-					if subtokens[k] == key {
-						subtokens[k] = strconv.Itoa(val)
-						//						fmt.Printf("Label Usage Replaced at line %d with %d\n", i, val)
-					}
-				}
-
-				val, err := strconv.Atoi(subtokens[k])
-				if err != nil {
-					return errors.New("malformed line c " + strconv.Itoa(i) + " : " + subtokens[k])
-				}
-				params = append(params, val)
+			diags = append(diags, NewDiagnostic(line, mnemonic, "unknown mnemonic '%s'", mnemonic.Text))
+			continue
+		}
+
+		if len(operands) != int(InstructionParams[op]) {
+			diags = append(diags, NewDiagnostic(line, mnemonic, "'%s' takes %d operands, but has %d", op.String(), InstructionParams[op], len(operands)))
+			continue
+		}
+
+		var params []int
+		ok := true
+		for i, operand := range operands {
+			var val int64
+			var err *Diagnostic
+			switch InstructionOperand(op, i) {
+			case otRegister:
+				val, err = evaluateRegister(line, operand, symbols)
+			case otCondition:
+				val, err = evaluateCondition(line, operand)
+			case otDirection:
+				val, err = evaluateDirection(line, operand, network)
+			case otReduction:
+				val, err = evaluateReduction(line, operand)
+			default:
+				val, err = evaluateOperand(line, operand, symbols)
 			}
+			if err != nil {
+				diags = append(diags, *err)
+				ok = false
+				continue
+			}
+			bits := program.OperandBits(op, i)
+			if long[lineIndex] && isJumpTarget(op, i) {
+				bits = maxOperandBits(program, op, i)
+			}
+			if !fitsBits(val, bits) {
+				diags = append(diags, fieldDiagnostic(line, operand, program, OperandName(op, i), val, op, i))
+				ok = false
+				continue
+			}
+			params = append(params, int(val))
+		}
+		if !ok {
+			continue
+		}
+
+		if long[lineIndex] {
+			target := jumpOperand(op)
+			jumpBits := program.OperandBits(op, target)
+			program.PushMem(isExt, byte(0), uint16(params[target]>>jumpBits))
+			params[target] &= 1<<jumpBits - 1
 		}
 
 		for len(params) < 3 {
@@ -94,7 +196,7 @@ func ReplaceLabels(lines []string, labels map[string]int, program Program) error
 		}
 
 		if isMem(op) {
-			if op == isCload || op == isCstore { // cload and cstore have a memparam but no 1st param
+			if isMemOnly(op) { // cload, cstore and ext have a memparam but no 1st param
 				program.PushMem(op, byte(0), uint16(params[0]))
 			} else {
 				program.PushMem(op, byte(params[0]), uint16(params[1]))
@@ -106,138 +208,384 @@ func ReplaceLabels(lines []string, labels map[string]int, program Program) error
 			bytes = append(bytes, byte(params[2]))
 			program.Push(op, bytes)
 		}
+		listing.Record(program, line)
 	}
-	return nil
+	return diags
 }
 
-func ParseLabels(lines []string) (parsed []string, labels map[string]int) {
-	labels = make(map[string]int)
-	for i := 0; i < len(lines); i++ {
-		for labelEnd := strings.Index(lines[i], ":"); labelEnd != -1; labelEnd = strings.Index(lines[i], ":") {
-			labelStart := strings.LastIndex(lines[i][:labelEnd], "\n")
-			if labelStart == -1 {
-				labelStart = 0
-			}
-			label := lines[i][labelStart:labelEnd]
-			label = strings.TrimSpace(label)
-			//			fmt.Printf("Found Label: %s at %d\n", label, i)
-			labels[label] = i
-			lines[i] = strings.TrimSpace(lines[i][labelEnd+1:])
+/// @return the value of an operand, which is an expression of numbers, aliases, and labels
+func evaluateOperand(line SourceLine, operand Token, symbols SymbolLookup) (int64, *Diagnostic) {
+	if len(operand.Text) == 0 {
+		diag := NewDiagnostic(line, operand, "missing operand")
+		return 0, &diag
+	}
+	return EvaluateExpression(line, operand, symbols)
+}
 
-			if len(lines[i]) == 0 {
-				lines = append(lines[:i], lines[i+1:]...) // if the line only had this label, remove the blank line
-				i--
-			}
+/// @return the value of a data value, which is an expression, or a float literal like 0.5 or 1e-3
+/// @param float whether the machine's data is float64, so every value is stored as float64 bits. Otherwise float literals are errors.
+func evaluateValue(line SourceLine, value Token, symbols SymbolLookup, float bool) (int64, *Diagnostic) {
+	if f, ok := floatLiteral(value.Text); ok {
+		if !float {
+			diag := NewDiagnostic(line, value, "'%s' is a float, but the machine's data is integers; use -float", value.Text)
+			return 0, &diag
+		}
+		return int64(math.Float64bits(f)), nil
+	}
+	val, err := evaluateOperand(line, value, symbols)
+	return toData(val, float), err
+}
+
+/// @return the value of s, and whether it's a float literal, i.e. a number with a decimal point or exponent
+func floatLiteral(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if _, err := strconv.ParseInt(s, 0, 64); err == nil || isIdentifier(strings.TrimLeft(s, "+-")) {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+/// @return the value of a PE register operand, which is a register name like ar, or an expression
+func evaluateRegister(line SourceLine, operand Token, symbols SymbolLookup) (int64, *Diagnostic) {
+	if r := StringToRegister(strings.ToLower(operand.Text)); r != isInvalidRegister {
+		return int64(r), nil
+	}
+	val, err := evaluateOperand(line, operand, symbols)
+	if err == nil && !isRegister(val) {
+		diag := NewDiagnostic(line, operand, "'%s' is not a PE register, expected ar, rr or ix", operand.Text)
+		err = &diag
+	}
+	return val, err
+}
 
-			//			fmt.Printf("Label Line Replaced: X%sX\n", lines[i])
+/// @return the value of a condition operand, which is a condition name like lt
+func evaluateCondition(line SourceLine, operand Token) (int64, *Diagnostic) {
+	if c := StringToCondition(strings.ToLower(operand.Text)); c != isInvalidCondition {
+		return int64(c), nil
+	}
+	diag := NewDiagnostic(line, operand, "'%s' is not a condition, expected lt, eq, ne, le, gt or ge", operand.Text)
+	return 0, &diag
+}
+
+/// @return the value of a reduction operand, which is a reduction name like sum
+func evaluateReduction(line SourceLine, operand Token) (int64, *Diagnostic) {
+	if r := StringToReduction(strings.ToLower(operand.Text)); r != isInvalidReduction {
+		return int64(r), nil
+	}
+	diag := NewDiagnostic(line, operand, "'%s' is not a reduction, expected sum, prod, min, max, and, or or count", operand.Text)
+	return 0, &diag
+}
+
+/// @return the value of a direction operand, like right, which must be a direction of the network
+func evaluateDirection(line SourceLine, operand Token, network Network) (int64, *Diagnostic) {
+	if d := StringToDirection(strings.ToLower(operand.Text)); network.HasDirection(d) {
+		return int64(d), nil
+	}
+	diag := NewDiagnostic(line, operand, "'%s' is not a direction of a %s of %d PEs, expected %s", operand.Text, network.Topology.String(), network.NumPE, network.DirectionNames())
+	return 0, &diag
+}
+
+/// Turns the operands of a shorthand like `movA toR` into those of `mov ar,rr`
+func expandMovShorthand(from RegisterType, mnemonic Token, operands []Token) []Token {
+	expanded := []Token{{from.String(), mnemonic.Column + len("mov")}}
+	for _, operand := range operands {
+		lower := strings.ToLower(operand.Text)
+		if to := letterToRegister(strings.TrimPrefix(lower, "to")); strings.HasPrefix(lower, "to") && to != isInvalidRegister {
+			operand.Text = to.String()
 		}
+		expanded = append(expanded, operand)
 	}
-	return RemoveBlanks(lines), labels
+	return expanded
 }
 
-/// @todo accomodate BSS matrices larger than len(cu.PE)
-func ParsePseudoOperations(cu *ControlUnitData, lines []string, program Program) (parsed []string, err error) {
-	bytesPerPe := len(cu.Memory) / (len(cu.PE) + 1)
+/// @return the instruction and target of the jump on the line, and whether the line is a jump whose target could be evaluated
+func jumpTarget(line SourceLine, symbols SymbolLookup) (OpCode, int64, bool) {
+	tokens := line.Fields()
+	if len(tokens) == 0 {
+		return isInvalid, 0, false
+	}
+	op := StringToInstruction(strings.ToLower(tokens[0].Text))
+	operands := line.Operands(tokens[0])
+	for i, operand := range operands {
+		if isJumpTarget(op, i) {
+			target, err := evaluateOperand(line, operand, symbols)
+			return op, target, err == nil
+		}
+	}
+	return op, 0, false
+}
 
-	data := make(map[string]int) // map[alias] cu_memory_location
-	//	equiv := make(map[string]int) //map[alias] constant (usually to a CU IndexRegister location)
-	//	bss := make(map[string]int) //map[alias] pe_memory_location
+/// @return the number of bits an operand may have in the program's encoding. Jump targets may be extended by an ext instruction.
+func maxOperandBits(program Program, op OpCode, operand int) uint {
+	bits := program.OperandBits(op, operand)
+	if isJumpTarget(op, operand) {
+		bits += program.OperandBits(isExt, 0)
+	}
+	return bits
+}
 
-	var lastLine int
+/// @return whether val fits in an unsigned field of the given number of bits
+func fitsBits(val int64, bits uint) bool {
+	return val >= 0 && val < int64(1)<<bits
+}
 
-	nextBssLocation := 0
+/// @return a Diagnostic for a value which doesn't fit in the field of an operand in the program's encoding,
+///         naming the limit, and suggesting a wider arch if the value would fit there
+/// @param what what the value is, e.g. "jump target"
+func fieldDiagnostic(line SourceLine, token Token, program Program, what string, val int64, op OpCode, operand int) Diagnostic {
+	bits := maxOperandBits(program, op, operand)
+	if val < 0 {
+		return NewDiagnostic(line, token, "%s %d is negative; the %d-bit field in %s arch is unsigned", what, val, bits, program.Arch())
+	}
+	message := fmt.Sprintf("%s %d exceeds %d-bit field in %s arch", what, val, bits, program.Arch())
+	if widest := maxOperandBits(widestProgram, op, operand); widest > bits && fitsBits(val, widest) {
+		message += "; use -arch " + widestProgram.Arch()
+	}
+	return NewDiagnostic(line, token, "%s", message)
+}
 
-	for i, line := range lines {
-		lastLine = i
-		tokens := strings.Fields(line)
+func isIdentifier(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || (!unicode.IsDigit(r) && r != '@')) { // '@' is for macro local labels
+			return false
+		}
+	}
+	return true
+}
+
+/// CheckConditionals checks every vif has a vendif after it, with at most one velse between them, and every velse and vendif has a vif before it
+func CheckConditionals(lines []SourceLine) (diags Diagnostics) {
+	type conditional struct {
+		vif   SourceLine
+		token Token
+		velse bool
+	}
+	var open []conditional
+	for _, line := range lines {
+		tokens := line.Fields()
 		if len(tokens) == 0 {
 			continue
 		}
-		op := StringToInstruction(tokens[0])
-		if op != isInvalid { // valid op means we're done with pseudo-ops and have reached real instructions
-			break
+		mnemonic := tokens[0]
+		switch StringToInstruction(strings.ToLower(mnemonic.Text)) {
+		case isVif:
+			open = append(open, conditional{vif: line, token: mnemonic})
+		case isVelse:
+			if len(open) == 0 {
+				diags = append(diags, NewDiagnostic(line, mnemonic, "velse without a vif"))
+			} else if innermost := &open[len(open)-1]; innermost.velse {
+				diags = append(diags, NewDiagnostic(line, mnemonic, "second velse for the vif at %s:%d", innermost.vif.File, innermost.vif.Number))
+			} else {
+				innermost.velse = true
+			}
+		case isVendif:
+			if len(open) == 0 {
+				diags = append(diags, NewDiagnostic(line, mnemonic, "vendif without a vif"))
+			} else {
+				open = open[:len(open)-1]
+			}
 		}
+	}
+	for _, c := range open {
+		diags = append(diags, NewDiagnostic(c.vif, c.token, "vif without a vendif"))
+	}
+	return diags
+}
+
+/// Removes labels from the lines, and defines them in the symbol table. A label is an identifier followed by a colon, at the start of a line.
+/// @return the lines without labels
+func ParseLabels(lines []SourceLine, symbols *SymbolTable) (parsed []SourceLine, diags Diagnostics) {
+	for i := 0; i < len(lines); i++ {
+		for label, labelEnd := leadingLabel(lines[i].Code); labelEnd != -1; label, labelEnd = leadingLabel(lines[i].Code) {
+			if !isIdentifier(label.Text) {
+				diags = append(diags, NewDiagnostic(lines[i], label, "invalid label '%s'", label.Text))
+			} else {
+				symbols.Define(&Symbol{Name: strings.ToLower(label.Text), Kind: skLabel, Line: lines[i], Token: label, Index: i})
+			}
+			lines[i].Code = strings.Repeat(" ", labelEnd+1) + lines[i].Code[labelEnd+1:]
 
-		if len(tokens) < 3 {
-			return nil, errors.New("malformed line d " + strconv.Itoa(i))
+			if len(strings.TrimSpace(lines[i].Code)) == 0 {
+				lines = append(lines[:i], lines[i+1:]...) // if the line only had this label, remove the blank line
+				i--
+				break
+			}
 		}
+	}
+	return lines, diags
+}
+
+/// @return the label at the start of the code, and the position of its colon. -1 if the code doesn't start with a label.
+func leadingLabel(code string) (label Token, colon int) {
+	fields := SourceLine{Code: code}.Fields()
+	if len(fields) == 0 {
+		return Token{}, -1
+	}
+	first := fields[0]
+	if end := strings.Index(first.Text, ":"); end != -1 {
+		return Token{first.Text[:end], first.Column}, first.Column - 1 + end // "label:" or "label:lod"
+	}
+	if len(fields) > 1 && strings.HasPrefix(fields[1].Text, ":") {
+		return first, fields[1].Column - 1 // "label :"
+	}
+	return Token{}, -1
+}
 
-		alias := strings.ToLower(tokens[0])
-		opType := strings.ToLower(tokens[1])
-		strVal := tokens[2]
+/// Removes the pseudo-operations and .init directives from the lines, and defines their aliases in the symbol table.
+/// `.init address = value,value,...` initializes memory at an address, which may be CU or PE memory.
+/// Pseudo-operations may be anywhere in the program, and are evaluated after every symbol is defined.
+/// @return the remaining lines, which are instructions and labels
+func ParsePseudoOperations(lines []SourceLine, symbols *SymbolTable) (parsed []SourceLine, diags Diagnostics) {
+	for _, line := range lines {
+		labels, rest := splitLeadingLabels(line)
+		tokens := rest.Fields()
+		isInit := len(tokens) != 0 && strings.ToLower(tokens[0].Text) == ".init"
+		if !isInit && !isPseudoOpLine(tokens) {
+			parsed = append(parsed, line)
+			continue
+		}
+		if len(strings.TrimSpace(labels.Code)) != 0 {
+			diags = append(diags, NewDiagnostic(line, labels.Fields()[0], "a pseudo-op can't have a label, only instructions can"))
+			continue
+		}
+
+		if isInit {
+			address, init := splitBssInit(line.Rest(tokens[0]))
+			if len(address.Text) == 0 || init == nil || len(init.Text) == 0 {
+				diags = append(diags, NewDiagnostic(line, tokens[0], "expected '.init address = value,value,...'"))
+				continue
+			}
+			symbols.Define(&Symbol{Kind: skInit, Line: line, Token: tokens[0], Value: address, Init: init})
+			continue
+		}
+
+		alias := strings.ToLower(tokens[0].Text)
+		opType := strings.ToLower(tokens[1].Text)
+		strVal := line.Rest(tokens[1])
+		if len(strVal.Text) == 0 {
+			diags = append(diags, NewDiagnostic(line, tokens[1], "missing value, expected '%s %s value'", tokens[0].Text, opType))
+			continue
+		}
+		if !isIdentifier(alias) {
+			diags = append(diags, NewDiagnostic(line, tokens[0], "invalid alias '%s'", tokens[0].Text))
+			continue
+		}
 
+		sym := &Symbol{Name: alias, Line: line, Token: tokens[0], Value: strVal}
 		switch opType {
 		case "data":
-			val, err := strconv.Atoi(strVal)
-			if err != nil {
-				return nil, errors.New("malformed line e " + strconv.Itoa(i))
-			}
-			location := program.DataOp(cu, byte(val))
-			data[alias] = int(location)
+			sym.Kind = skData
 		case "equiv":
-			val, err := strconv.Atoi(strVal)
-			if err != nil {
-				return nil, errors.New("malformed line f " + strconv.Itoa(i))
-			}
-			data[alias] = val
+			sym.Kind = skEquiv
 		case "bss":
-			vals := strings.Split(strVal, "x")
-			if len(vals) != 2 {
-				return nil, errors.New("malformed line g " + strconv.Itoa(i))
-			}
-			width, err := strconv.Atoi(vals[0])
-			if err != nil {
-				return nil, errors.New("malformed line h " + strconv.Itoa(i))
-			}
-			height, err := strconv.Atoi(vals[1])
-			if err != nil {
-				return nil, errors.New("malformed line i " + strconv.Itoa(i))
-			}
-			if width > len(cu.PE) {
-				return nil, errors.New("line " + strconv.Itoa(i) + " exceeds number of Vector Processing Elements: " + strconv.Itoa(width) + ">" + strconv.Itoa(len(cu.PE)))
-				/// @todo accomodate BSS matrices wider than len(cu.PE)
+			sym.Kind = skBss
+			_, sym.Init = splitBssInit(strVal)
+		}
+		symbols.Define(sym)
+	}
+	return parsed, diags
+}
+
+/// ParseMachine removes the .machine directive, which gives the machine the program is for as the flags which configure it,
+/// e.g. `.machine arch=32bit numpe=16 float=true`. Flags left out keep the machine's value.
+/// @param machine the machine, to which the directive's flags are applied
+/// @return the lines without the directive, and the directive, or nil if there is none
+func ParseMachine(lines []SourceLine, machine *ProgramHeader) (parsed []SourceLine, directive *SourceLine, diags Diagnostics) {
+	for i, line := range lines {
+		tokens := line.Fields()
+		if len(tokens) == 0 || strings.ToLower(tokens[0].Text) != ".machine" {
+			parsed = append(parsed, line)
+			continue
+		}
+		if directive != nil {
+			diags = append(diags, NewDiagnostic(line, tokens[0], "duplicate .machine, the first is at %s:%d", directive.File, directive.Number))
+			continue
+		}
+		directive = &lines[i]
+		for _, token := range tokens[1:] {
+			equals := strings.Index(token.Text, "=")
+			if equals == -1 {
+				diags = append(diags, NewDiagnostic(line, token, "expected 'flag=value', like numpe=16"))
+				continue
 			}
-			if height+nextBssLocation > bytesPerPe {
-				//				fmt.Printf("Error exceeds width: %d, nbss: %d, bytesPerPe: %d\n", width, nextBssLocation, bytesPerPe)
-				return nil, errors.New("line " + strconv.Itoa(i) + " exceeds memory of Vector Processing Elements: " + "w: " + strconv.Itoa(width) + ">" + strconv.Itoa(len(cu.PE)) + "h: " + strconv.Itoa(height) + "+" + strconv.Itoa(nextBssLocation) + ">" + strconv.Itoa(bytesPerPe))
+			if err := machine.Configure(strings.ToLower(token.Text[:equals]), token.Text[equals+1:]); err != nil {
+				diags = append(diags, NewDiagnostic(line, token, "%s", err.Error()))
 			}
+		}
+	}
+	return parsed, directive, diags
+}
 
-			data[alias] = nextBssLocation
-			nextBssLocation += height
+/// Splits a bss value like `3x3 = 1,2,3...` into the dimension and the initial values, if any
+func splitBssInit(val Token) (dimension Token, init *Token) {
+	equals := strings.Index(val.Text, "=")
+	if equals == -1 {
+		return val, nil
+	}
+	dimension = trimToken(Token{val.Text[:equals], val.Column})
+	values := trimToken(Token{val.Text[equals+1:], val.Column + equals + 1})
+	return dimension, &values
+}
 
-		default:
-			return nil, errors.New("malformed line j " + strconv.Itoa(i))
+/// Evaluates the initial values of a bss matrix, either a list of every value by row, `1,2,3,...`, or `fill(value)`
+/// @param count the number of values in the matrix
+/// @return the values by row, or nil if there are any errors
+func evaluateBssInit(line SourceLine, init Token, count int, symbols SymbolLookup, float bool) (values []int64, diags Diagnostics) {
+	lower := strings.ToLower(init.Text)
+	if strings.HasPrefix(lower, "fill(") && strings.HasSuffix(lower, ")") {
+		fill := trimToken(Token{init.Text[len("fill(") : len(init.Text)-1], init.Column + len("fill(")})
+		val, err := evaluateValue(line, fill, symbols, float)
+		if err != nil {
+			return nil, Diagnostics{*err}
 		}
+		for i := 0; i < count; i++ {
+			values = append(values, val)
+		}
+		return values, nil
+	}
 
+	if exprs := splitInit(init); len(exprs) != count {
+		return nil, Diagnostics{NewDiagnostic(line, init, "bss has %d elements, but %d initial values", count, len(exprs))}
 	}
-	/*
-		fmt.Println("ParsedPseudoOps:")
-		fmt.Print("Lines: ")
-		fmt.Println(lines)
-		fmt.Print("linesPostPseu: ")
-		fmt.Println(lines[lastLine:])
-		fmt.Print("aliases: ")
-		fmt.Println(data)
-	*/
-	lines = ReplacePseudoOpAliases(lines[lastLine:], data)
-	return lines, nil
+	return evaluateInit(line, init, symbols, float)
 }
 
-func ReplacePseudoOpAliases(lines []string, aliases map[string]int) []string {
-	for i, line := range lines {
-		tokens := strings.Fields(line)
-		for j, token := range tokens {
-			subtokens := strings.Split(token, ",")
-			for k, _ := range subtokens {
-				subtokens[k] = strings.ToLower(subtokens[k])
-				if val, ok := aliases[subtokens[k]]; ok {
-					// alias found!
-					subtokens[k] = strconv.Itoa(val)
-					tokens[j] = strings.Join(subtokens, ",")
-					lines[i] = strings.Join(tokens, " ")
-				}
-			}
+/// Evaluates a list of initial values, `1,2,3,...`
+/// @return the values, or nil if there are any errors
+func evaluateInit(line SourceLine, init Token, symbols SymbolLookup, float bool) (values []int64, diags Diagnostics) {
+	for _, expr := range splitInit(init) {
+		val, err := evaluateValue(line, expr, symbols, float)
+		if err != nil {
+			diags = append(diags, *err)
+			continue
 		}
+		values = append(values, val)
 	}
-	return lines
+	if len(diags) != 0 {
+		return nil, diags
+	}
+	return values, nil
+}
+
+/// @return the comma separated expressions of a list of initial values
+func splitInit(init Token) []Token {
+	return SourceLine{Code: strings.Repeat(" ", init.Column-1) + init.Text}.Operands(Token{"", init.Column})
+}
+
+/// @return whether the tokens are a pseudo-op, like `alias data value`,
+///         rather than an instruction whose operand is a label named data, equiv or bss, like `jmp data`
+func isPseudoOpLine(tokens []Token) bool {
+	if len(tokens) < 2 || !isPseudoOp(strings.ToLower(tokens[1].Text)) {
+		return false
+	}
+	mnemonic := strings.ToLower(tokens[0].Text)
+	_, shorthand := movShorthand(mnemonic)
+	return StringToInstruction(mnemonic) == isInvalid && !shorthand
+}
+
+func isPseudoOp(s string) bool {
+	return s == "data" || s == "equiv" || s == "bss"
 }
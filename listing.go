@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/// Listing is the source line of each instruction and initialized data value in a program
+type Listing struct {
+	Instructions []SourceLine       ///< by instruction index
+	Data         map[int]SourceLine ///< by memory address
+}
+
+/// Record attributes every instruction pushed to the program since the last Record to the given line.
+/// Does nothing if l is nil.
+func (l *Listing) Record(program Program, line SourceLine) {
+	if l == nil {
+		return
+	}
+	for int64(len(l.Instructions)) < program.Size() {
+		l.Instructions = append(l.Instructions, line)
+	}
+}
+
+/// RecordData attributes count data values, starting at the given memory address, to the given line.
+/// Does nothing if l is nil.
+func (l *Listing) RecordData(address int, count int, line SourceLine) {
+	if l == nil {
+		return
+	}
+	if l.Data == nil {
+		l.Data = make(map[int]SourceLine)
+	}
+	for i := 0; i < count; i++ {
+		l.Data[address+i] = line
+	}
+}
+
+/// Write writes the index, raw bytes, decoded fields, and source line of each instruction in the program,
+/// followed by the address, value, and source line of each value in its data section
+func (l Listing) Write(w io.Writer, program Program) error {
+	for i := int64(0); i < program.Size(); i++ {
+		instruction := program.At(i)
+
+		var bytes []string
+		for _, b := range instruction {
+			bytes = append(bytes, fmt.Sprintf("%02x", b))
+		}
+
+		params := program.Decode(instruction)
+		var decoded string
+		if params.IsMem() {
+			decoded = fmt.Sprintf("%5s  P: %d  MP: %d", params.Op().String(), params.Param(), params.MemParam())
+		} else {
+			p := params.Params()
+			decoded = fmt.Sprintf("%5s  P1: %d  P2: %d  P3: %d", params.Op().String(), p[0], p[1], p[2])
+		}
+
+		source := ""
+		if i < int64(len(l.Instructions)) {
+			source = l.source(l.Instructions[i])
+		}
+
+		_, err := fmt.Fprintf(w, "%4d  %-11s  %-32s  %s\n", i, strings.Join(bytes, " "), decoded, source)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, segment := range program.Data() {
+		for i, val := range segment.Values {
+			address := segment.Address + i
+			_, err := fmt.Fprintf(w, "data  %-11d  %-32d  %s\n", address, val, l.source(l.Data[address]))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/// @return the location and text of the line, or the empty string if there's no line
+func (l Listing) source(line SourceLine) string {
+	if line.File == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d: %s", line.File, line.Number, strings.TrimSpace(line.Text))
+}
+
+/// WriteFile writes the listing to the given file, creating or truncating it
+func (l Listing) WriteFile(file string, program Program) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	err = l.Write(f, program)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
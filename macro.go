@@ -0,0 +1,217 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/// maxMacroDepth limits how deeply macros may invoke other macros, so recursive macros fail rather than hang
+const maxMacroDepth = 64
+
+/// Macro is a named block of source lines, defined with
+///
+///     .macro name param1,param2
+///     ...
+///     .endm
+///
+/// and invoked like an instruction, `name arg1,arg2`.
+type Macro struct {
+	Name       string
+	Params     []string
+	Body       []SourceLine
+	Definition SourceLine
+	labels     map[string]bool ///< labels defined in the body, which are made unique in each expansion
+}
+
+/// ExpandMacros removes macro definitions from the lines, and replaces each macro invocation with the macro body.
+/// Parameters in the body are replaced by the invocation's arguments.
+/// Labels defined in the body are local to each expansion, and are renamed label@N so they don't collide.
+func ExpandMacros(lines []SourceLine) (expanded []SourceLine, diags Diagnostics) {
+	lines, macros, diags := parseMacros(lines)
+	if len(macros) == 0 {
+		return lines, diags
+	}
+	expansions := 0
+	expanded, expandDiags := expandMacros(lines, macros, &expansions, 0)
+	return expanded, append(diags, expandDiags...)
+}
+
+/// @return the lines without macro definitions, and the macros defined
+func parseMacros(lines []SourceLine) (parsed []SourceLine, macros map[string]*Macro, diags Diagnostics) {
+	macros = make(map[string]*Macro)
+	var macro *Macro
+	for _, line := range lines {
+		tokens := line.Fields()
+		directive := ""
+		if len(tokens) != 0 {
+			directive = strings.ToLower(tokens[0].Text)
+		}
+
+		switch {
+		case directive == ".macro" && macro != nil:
+			diags = append(diags, NewDiagnostic(line, tokens[0], "nested macro definitions are not supported"))
+		case directive == ".macro":
+			macro = &Macro{Definition: line, labels: make(map[string]bool)}
+			if len(tokens) < 2 || !isIdentifier(tokens[1].Text) {
+				diags = append(diags, NewDiagnostic(line, tokens[0], "expected a macro name after '.macro'"))
+				continue
+			}
+			macro.Name = strings.ToLower(tokens[1].Text)
+			for _, param := range line.Operands(tokens[1]) {
+				if !isIdentifier(param.Text) {
+					diags = append(diags, NewDiagnostic(line, param, "invalid macro parameter '%s'", param.Text))
+					continue
+				}
+				macro.Params = append(macro.Params, strings.ToLower(param.Text))
+			}
+			if StringToInstruction(macro.Name) != isInvalid {
+				diags = append(diags, NewDiagnostic(line, tokens[1], "macro '%s' has the same name as an instruction", tokens[1].Text))
+				macro.Name = ""
+			} else if previous, ok := macros[macro.Name]; ok {
+				diags = append(diags, NewDiagnostic(line, tokens[1], "macro '%s' is already defined at %s:%d", tokens[1].Text, previous.Definition.File, previous.Definition.Number))
+				macro.Name = ""
+			}
+		case directive == ".endm" && macro == nil:
+			diags = append(diags, NewDiagnostic(line, tokens[0], "'.endm' without '.macro'"))
+		case directive == ".endm":
+			if len(macro.Name) != 0 {
+				macros[macro.Name] = macro
+			}
+			macro = nil
+		case macro != nil:
+			code := line.Code
+			for label, colon := leadingLabel(code); colon != -1; label, colon = leadingLabel(code) {
+				macro.labels[strings.ToLower(label.Text)] = true
+				code = strings.Repeat(" ", colon+1) + code[colon+1:]
+			}
+			macro.Body = append(macro.Body, line)
+		default:
+			parsed = append(parsed, line)
+		}
+	}
+	if macro != nil {
+		diags = append(diags, NewLineDiagnostic(macro.Definition, "'.macro' without '.endm'"))
+	}
+	return parsed, macros, diags
+}
+
+/// @param expansions the number of expansions so far, used to make local labels unique
+func expandMacros(lines []SourceLine, macros map[string]*Macro, expansions *int, depth int) (expanded []SourceLine, diags Diagnostics) {
+	for _, line := range lines {
+		labels, invocation := splitLeadingLabels(line)
+		tokens := invocation.Fields()
+		if len(tokens) == 0 {
+			expanded = append(expanded, line)
+			continue
+		}
+		macro, ok := macros[strings.ToLower(tokens[0].Text)] // a macro invocation, even if its first argument is named data, equiv or bss
+		if !ok {
+			expanded = append(expanded, line)
+			continue
+		}
+
+		if depth >= maxMacroDepth {
+			diags = append(diags, NewDiagnostic(line, tokens[0], "macro '%s' expanded more than %d levels deep", macro.Name, maxMacroDepth))
+			continue
+		}
+		args := invocation.Operands(tokens[0])
+		if len(args) != len(macro.Params) {
+			diags = append(diags, NewDiagnostic(line, tokens[0], "macro '%s' takes %d arguments, but has %d", macro.Name, len(macro.Params), len(args)))
+			continue
+		}
+		argsOk := true
+		for _, arg := range args {
+			if len(arg.Text) == 0 {
+				diags = append(diags, NewDiagnostic(line, arg, "missing macro argument"))
+				argsOk = false
+			}
+		}
+		if !argsOk {
+			continue
+		}
+
+		if len(strings.TrimSpace(labels.Code)) != 0 {
+			expanded = append(expanded, labels) // labels on the invocation refer to the first line of the expansion
+		}
+
+		*expansions++
+		body := macro.expand(args, line, *expansions)
+		body, bodyDiags := expandMacros(body, macros, expansions, depth+1)
+		expanded = append(expanded, body...)
+		diags = append(diags, bodyDiags...)
+	}
+	return expanded, diags
+}
+
+/// @return the macro body with parameters replaced by the arguments, and local labels made unique
+func (m *Macro) expand(args []Token, invocation SourceLine, expansion int) []SourceLine {
+	values := make(map[string]string)
+	for i, param := range m.Params {
+		values[param] = args[i].Text
+	}
+	suffix := "@" + strconv.Itoa(expansion)
+
+	replace := func(word string) (string, bool) {
+		lower := strings.ToLower(word)
+		if val, ok := values[lower]; ok {
+			return val, true
+		}
+		if m.labels[lower] {
+			return lower + suffix, true
+		}
+		return "", false
+	}
+
+	body := make([]SourceLine, len(m.Body), len(m.Body))
+	for i, line := range m.Body {
+		code := replaceWords(line.Code, replace)
+		body[i] = line
+		body[i].Text = code
+		body[i].Code = code
+		body[i].Expansion = &invocation
+	}
+	return body
+}
+
+/// splits a line into its leading labels, and the rest of the line. Both keep their columns.
+func splitLeadingLabels(line SourceLine) (labels SourceLine, rest SourceLine) {
+	end := 0
+	rest = line
+	for _, colon := leadingLabel(rest.Code); colon != -1; _, colon = leadingLabel(rest.Code) {
+		end = colon + 1
+		rest.Code = strings.Repeat(" ", end) + line.Code[end:]
+	}
+	labels = line
+	labels.Code = line.Code[:end]
+	return labels, rest
+}
+
+/// replaces every identifier in s for which replace returns true
+func replaceWords(s string, replace func(word string) (string, bool)) string {
+	var out strings.Builder
+	start := -1
+	flush := func(end int) {
+		word := s[start:end]
+		if replacement, ok := replace(word); ok {
+			word = replacement
+		}
+		out.WriteString(word)
+		start = -1
+	}
+	for i, r := range s {
+		isWordChar := r == '_' || r == '@' || unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWordChar && start == -1 {
+			start = i
+		} else if !isWordChar {
+			if start != -1 {
+				flush(i)
+			}
+			out.WriteRune(r)
+		}
+	}
+	if start != -1 {
+		flush(len(s))
+	}
+	return out.String()
+}
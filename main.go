@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -17,17 +19,72 @@ const (
 	at32bit
 )
 
+func (a ArchitectureType) String() string {
+	switch a {
+	case at24bit:
+		return "24bit"
+	case at24bitpipelined:
+		return "24bitpipelined"
+	case at32bit:
+		return "32bit"
+	}
+	return "NUL"
+}
+
+const isInvalidArchitecture = ^ArchitectureType(0)
+
+/// @return the architecture with the given name, e.g. 32bit
+func StringToArchitecture(s string) ArchitectureType {
+	switch s {
+	case "24bit":
+		return at24bit
+	case "24bitpipelined":
+		return at24bitpipelined
+	case "32bit":
+		return at32bit
+	}
+	return isInvalidArchitecture
+}
+
+/// @return the number of bytes in each instruction of the architecture
+func (a ArchitectureType) InstructionLength() int {
+	if a == at32bit {
+		return InstructionLength32bit
+	}
+	return InstructionLength24bit
+}
+
 const version = "1.0.2"
 
 var compileFile string
 var outputFile string
+var listingFile string
 var verbose bool
+var legacy bool
 var script bool
 var archString string
 var arch ArchitectureType
 var memoryPerPe uint
 var numPe uint
 var numIndexRegisters uint
+var returnStackDepth uint
+var maskStackDepth uint
+var float bool
+var topologyString string
+var topology Topology
+var includePaths pathList
+
+/// pathList is a flag which may be given multiple times, each a path or a list of paths
+type pathList []string
+
+func (p *pathList) String() string {
+	return strings.Join(*p, string(filepath.ListSeparator))
+}
+
+func (p *pathList) Set(s string) error {
+	*p = append(*p, filepath.SplitList(s)...)
+	return nil
+}
 
 func init() {
 	const (
@@ -40,7 +97,7 @@ func init() {
 		scriptDefault  = false
 		scriptUsage    = "Act as script, immediately output the execution result of the given assembly file."
 		archDefault    = "24bit"
-		archUsage      = "Machine architecture: 24bit, 24bitpipelined, 32bit."
+		archUsage      = "Machine architecture: 24bit, 24bitpipelined, 32bit. Running a program file defaults to the architecture and machine size it was compiled for."
 		peMemDefault   = 64
 		peMemUsage     = `Memory per processing element. 
         CAUTION: setting more than the instruction set can address will result in undefined behavior.`
@@ -50,6 +107,14 @@ func init() {
 		numIndexRegistersDefault = 64
 		numIndexRegistersUsage   = `Number of index registers. 
         CAUTION: setting more than the instruction set can address will result in undefined behavior.`
+		includeUsage = "Directory to search for .include files. May be given multiple times."
+		listingUsage = "File to write an assembly listing to, when compiling."
+		legacyUsage  = "Run program files from older versions, which have no header describing the machine they were compiled for. They must be run with the same -arch, -numpe, -pemem and -indexregisters they were compiled with."
+
+		returnStackUsage = "Depth of the Control Unit's return stack, the most calls which may be nested."
+		maskStackUsage   = "Depth of the Control Unit's mask stack, the most vifs which may be nested."
+		topologyUsage    = "How the PEs are connected, which decides the directions of shift and rotate: ring (right, left), mesh (right, left, down, up; a square number of PEs) or hypercube (dim0, dim1...; a power of 2 PEs). Running a program file defaults to the topology it was compiled for."
+		floatUsage       = "Data is float64 rather than int64, in PE and CU memory, except in index registers, which ldx and stx convert to and from. Data values may be floats, like 0.5. Running a program file defaults to the mode it was compiled for."
 	)
 	flag.StringVar(&compileFile, "compile", compileDefault, compileUsage)
 	flag.StringVar(&compileFile, "c", compileDefault, compileUsage+" (shorthand)")
@@ -64,6 +129,13 @@ func init() {
 	flag.UintVar(&memoryPerPe, "pemem", peMemDefault, peMemUsage)
 	flag.UintVar(&numPe, "numpe", numPeDefault, numPeUsage)
 	flag.UintVar(&numIndexRegisters, "indexregisters", numIndexRegistersDefault, numIndexRegistersUsage)
+	flag.UintVar(&returnStackDepth, "returnstack", DefaultReturnStackDepth, returnStackUsage)
+	flag.UintVar(&maskStackDepth, "maskstack", DefaultMaskStackDepth, maskStackUsage)
+	flag.BoolVar(&float, "float", false, floatUsage)
+	flag.StringVar(&topologyString, "topology", "ring", topologyUsage)
+	flag.Var(&includePaths, "I", includeUsage)
+	flag.StringVar(&listingFile, "listing", "", listingUsage)
+	flag.BoolVar(&legacy, "legacy", false, legacyUsage)
 }
 
 func printUsage() {
@@ -72,30 +144,73 @@ func printUsage() {
 	fmt.Println("\t" + exeName + " -c file-to-compile.sasm -o output-file")
 	fmt.Println("\t" + exeName + " file-to-execute.simd")
 	fmt.Println("\t" + exeName + " -s file-to-execute.sasm")
+	fmt.Println("\t" + exeName + " disasm file-to-disassemble.simd")
 	fmt.Println("flags:")
 	flag.PrintDefaults()
 	fmt.Println("example:\n\t" + exeName + " -c input.sasm")
 	fmt.Println("\t" + exeName + " -c input.sasm -o matrix_multiply.simd")
+	fmt.Println("\t" + exeName + " -I lib -c input.sasm")
+	fmt.Println("\t" + exeName + " -c input.sasm -listing input.lst")
 	fmt.Println("\t" + exeName + " output.simd")
+	fmt.Println("\t" + exeName + " -a 24bitpipelined output.simd")
+	fmt.Println("\t" + exeName + " disasm output.simd -a 32bit > output.sasm")
+}
+
+/// parses the flags in args, including flags after positional arguments, like `disasm file.simd -a 32bit`
+/// @return the positional arguments
+func parseInterspersedFlags(args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := flag.CommandLine.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		if flag.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flag.Arg(0))
+		args = flag.Args()[1:]
+	}
 }
 
 func parseEnumArgs() {
-	switch archString {
-	case "24bit":
-		arch = at24bit
-	case "24bitpipelined":
-		arch = at24bitpipelined
-	case "32bit":
-		arch = at32bit
-	default:
+	arch = StringToArchitecture(archString)
+	if arch == isInvalidArchitecture {
 		arch = at24bit
 	}
+	topology = StringToTopology(topologyString)
+	if topology == isInvalidTopology {
+		topology = topoRing
+	}
 }
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	flag.Parse()
+
+	if flag.Arg(0) == "disasm" {
+		args, err := parseInterspersedFlags(flag.Args()[1:])
+		if err != nil || len(args) != 1 {
+			printUsage()
+			return
+		}
+		parseEnumArgs()
+		err = disassemble(args[0], arch)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	parseEnumArgs()
+	if script {
+		configureFromSource(flag.Arg(0))
+	} else if len(compileFile) != 0 {
+		configureFromSource(compileFile)
+	} else if flag.NArg() > 0 {
+		configureFromProgram(flag.Arg(0))
+	}
 
 	var cu ControlUnit
 	switch arch {
@@ -109,6 +224,15 @@ func main() {
 		cu = NewControlUnit24bit(numIndexRegisters, numPe, memoryPerPe)
 	}
 	cu.Data().Verbose = verbose
+	cu.Data().Legacy = legacy
+	cu.Data().ReturnStackDepth = int(returnStackDepth)
+	cu.Data().MaskStackDepth = int(maskStackDepth)
+	cu.Data().SetFloat(float)
+	cu.Data().Topology = topology
+	if err := cu.Data().Network().Check(); err != nil {
+		fmt.Println(err)
+		return
+	}
 
 	if script {
 		compileFile = flag.Arg(0)
@@ -127,7 +251,7 @@ func main() {
 			fmt.Println(err)
 			return
 		}
-		err = program.Save(outputFile)
+		err = program.Save(outputFile, NewProgramHeader(arch, cu.Data()))
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -141,13 +265,67 @@ func main() {
 	run(cu)
 }
 
-func compile(cu ControlUnit, arch ArchitectureType) (Program, error) {
-	bytes, err := ioutil.ReadFile(compileFile)
+/// Sets the architecture, machine size, data mode and topology to those in the program file's header, except those given explicitly as flags.
+/// Legacy files without a header, and files which can't be loaded, are left for Run to report.
+func configureFromProgram(file string) {
+	_, header, err := LoadProgram(file, true, arch)
+	if err != nil || header == nil {
+		return
+	}
+	configureFromHeader(*header)
+}
+
+/// Sets the architecture, machine size, data mode and topology to those in the source file's .machine directive, except those given explicitly as flags.
+/// Only the file itself is searched, not the files it includes. Errors in the directive are left for the assembler to report.
+func configureFromSource(file string) {
+	source, err := ioutil.ReadFile(file)
 	if err != nil {
-		return nil, err
+		return
+	}
+	header := ProgramHeader{
+		Arch:           arch,
+		NumPE:          uint32(numPe),
+		PEMemory:       uint32(memoryPerPe),
+		IndexRegisters: uint32(numIndexRegisters),
+		Topology:       topology,
+	}
+	if float {
+		header.Flags |= flagFloat
+	}
+	_, directive, _ := ParseMachine(SplitLines(file, string(source)), &header)
+	if directive == nil {
+		return
+	}
+	configureFromHeader(header)
+}
+
+/// Sets the architecture, machine size, data mode and topology to those of the header, except those given explicitly as flags.
+func configureFromHeader(header ProgramHeader) {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	if !explicit["arch"] && !explicit["a"] {
+		arch = header.Arch
+	}
+	if !explicit["numpe"] {
+		numPe = uint(header.NumPE)
 	}
+	if !explicit["pemem"] {
+		memoryPerPe = uint(header.PEMemory)
+	}
+	if !explicit["indexregisters"] {
+		numIndexRegisters = uint(header.IndexRegisters)
+	}
+	if !explicit["float"] {
+		float = header.Float()
+	}
+	if !explicit["topology"] {
+		topology = header.Topology
+	}
+}
 
-	input := string(bytes)
+func compile(cu ControlUnit, arch ArchitectureType) (Program, error) {
 	var program Program
 	switch arch {
 	case at24bit:
@@ -159,19 +337,39 @@ func compile(cu ControlUnit, arch ArchitectureType) (Program, error) {
 	default:
 		program = NewProgram24bit()
 	}
-	err = LexProgram(cu.Data(), input, program)
+	assembler := NewAssembler(cu.Data(), program)
+	assembler.IncludePaths = includePaths
+	err := assembler.AssembleFile(compileFile)
 	if err != nil {
 		return nil, err
 	}
+	if len(listingFile) != 0 {
+		err = assembler.Listing.WriteFile(listingFile, program)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return program, nil
 }
 
-func run(cu ControlUnit) {
-	testLoadMatrices(cu.Data()) ///< @todo change sample input to load matrices within instructions, so this is unnecessary
+/// writes the given binary as assembly to stdout
+/// @param arch the architecture of legacy files without a header
+func disassemble(file string, arch ArchitectureType) error {
+	program, header, err := LoadProgram(file, legacy, arch)
+	if err != nil {
+		return err
+	}
+	return Disassemble(os.Stdout, program, header)
+}
 
+func run(cu ControlUnit) {
 	programFile := flag.Arg(0)
 	start := time.Now()
-	cu.Run(programFile)
+	err := cu.Run(programFile)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	executionTime := time.Now().Sub(start)
 	fmt.Print("Program executed in ")
 	fmt.Print(executionTime)
@@ -192,9 +390,12 @@ func run(cu ControlUnit) {
 }
 
 func runProgram(cu ControlUnit, program Program) {
-	testLoadMatrices(cu.Data()) ///< @todo change sample input to load matrices within instructions, so this is unnecessary
 	start := time.Now()
-	cu.RunProgram(program)
+	err := cu.RunProgram(program)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	executionTime := time.Now().Sub(start)
 	fmt.Print("Program executed in ")
 	fmt.Print(executionTime)
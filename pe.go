@@ -1,23 +1,47 @@
 package main
 
+import (
+	"math"
+)
+
+/// CompareTuple is the condition, memory address, and index of a vcmp
+type CompareTuple struct {
+	Cond  Condition
+	A     byte
+	Index byte
+}
+
+/// LogicTuple is the instruction, memory address, and index of a bitwise or shift instruction, like and
+type LogicTuple struct {
+	Op    OpCode
+	A     byte
+	Index byte
+}
+
 type ProcessingElement struct {
 	ArithmeticRegister int64
 	RoutingRegister    int64
 	Index              int64
 	Enabled            bool
+	Float              bool ///< whether data is float64, stored as its bits, rather than int64
 	Memory             []int64
 
-	Lod  chan ByteTuple
-	Sto  chan ByteTuple
-	Add  chan ByteTuple
-	Sub  chan ByteTuple
-	Mul  chan ByteTuple
-	Div  chan ByteTuple
-	Mov  chan ByteTuple
-	Radd chan bool
-	Rsub chan bool
-	Rmul chan bool
-	Rdiv chan bool
+	Lod    chan ByteTuple
+	Sto    chan ByteTuple
+	Add    chan ByteTuple
+	Sub    chan ByteTuple
+	Mul    chan ByteTuple
+	Div    chan ByteTuple
+	Mov    chan ByteTuple
+	Radd   chan bool
+	Rsub   chan bool
+	Rmul   chan bool
+	Rdiv   chan bool
+	Cmp    chan CompareTuple
+	Rcmp   chan Condition
+	Zcmp   chan Condition
+	Logic  chan LogicTuple
+	Rlogic chan OpCode
 
 	Done chan bool ///< the PE writes to this when an instruction finishes.
 }
@@ -47,6 +71,16 @@ func (pe *ProcessingElement) Run() {
 			pe.DoRmul()
 		case <-pe.Rdiv:
 			pe.DoRdiv()
+		case p := <-pe.Cmp:
+			pe.DoCmp(p.Cond, p.A, p.Index)
+		case c := <-pe.Rcmp:
+			pe.DoRcmp(c)
+		case c := <-pe.Zcmp:
+			pe.DoZcmp(c)
+		case p := <-pe.Logic:
+			pe.DoLogic(p.Op, p.A, p.Index)
+		case op := <-pe.Rlogic:
+			pe.DoRlogic(op)
 		}
 		pe.Done <- true
 	}
@@ -59,28 +93,25 @@ func (pe *ProcessingElement) DoAdd(a byte, i byte) {
 	if !pe.Enabled {
 		return
 	}
-	pe.ArithmeticRegister += pe.Memory[a+i]
+	pe.ArithmeticRegister = arithmetic(isAdd, pe.ArithmeticRegister, pe.Memory[a+i], pe.Float)
 }
 func (pe *ProcessingElement) DoSub(a byte, i byte) {
 	if !pe.Enabled {
 		return
 	}
-	pe.ArithmeticRegister -= pe.Memory[a+i]
+	pe.ArithmeticRegister = arithmetic(isSub, pe.ArithmeticRegister, pe.Memory[a+i], pe.Float)
 }
 func (pe *ProcessingElement) DoMul(a byte, i byte) {
 	if !pe.Enabled {
 		return
 	}
-	pe.ArithmeticRegister *= pe.Memory[a+i]
+	pe.ArithmeticRegister = arithmetic(isMul, pe.ArithmeticRegister, pe.Memory[a+i], pe.Float)
 }
 func (pe *ProcessingElement) DoDiv(a byte, i byte) {
 	if !pe.Enabled {
 		return
 	}
-	if pe.ArithmeticRegister == 0 {
-		return
-	}
-	pe.ArithmeticRegister /= pe.Memory[a+i]
+	pe.ArithmeticRegister = arithmetic(isDiv, pe.ArithmeticRegister, pe.Memory[a+i], pe.Float)
 }
 
 // lod operation for individual PE
@@ -128,23 +159,92 @@ func (pe *ProcessingElement) DoRadd() {
 	if !pe.Enabled {
 		return
 	}
-	pe.ArithmeticRegister += pe.RoutingRegister
+	pe.ArithmeticRegister = arithmetic(isAdd, pe.ArithmeticRegister, pe.RoutingRegister, pe.Float)
 }
 func (pe *ProcessingElement) DoRsub() {
 	if !pe.Enabled {
 		return
 	}
-	pe.ArithmeticRegister -= pe.RoutingRegister
+	pe.ArithmeticRegister = arithmetic(isSub, pe.ArithmeticRegister, pe.RoutingRegister, pe.Float)
 }
 func (pe *ProcessingElement) DoRmul() {
 	if !pe.Enabled {
 		return
 	}
-	pe.ArithmeticRegister *= pe.RoutingRegister
+	pe.ArithmeticRegister = arithmetic(isMul, pe.ArithmeticRegister, pe.RoutingRegister, pe.Float)
 }
 func (pe *ProcessingElement) DoRdiv() {
 	if !pe.Enabled {
 		return
 	}
-	pe.ArithmeticRegister /= pe.RoutingRegister
+	pe.ArithmeticRegister = arithmetic(isDiv, pe.ArithmeticRegister, pe.RoutingRegister, pe.Float)
+}
+func (pe *ProcessingElement) DoLogic(op OpCode, a byte, i byte) {
+	if !pe.Enabled {
+		return
+	}
+	pe.ArithmeticRegister = logic(op, pe.ArithmeticRegister, pe.Memory[a+i])
+}
+func (pe *ProcessingElement) DoRlogic(op OpCode) {
+	if !pe.Enabled {
+		return
+	}
+	pe.ArithmeticRegister = logic(op, pe.ArithmeticRegister, pe.RoutingRegister)
+}
+
+///
+/// Compares set the enable bit of every PE, including disabled ones
+///
+func (pe *ProcessingElement) DoCmp(c Condition, a byte, i byte) {
+	pe.Enabled = compare(c, pe.ArithmeticRegister, pe.Memory[a+i], pe.Float)
+}
+func (pe *ProcessingElement) DoRcmp(c Condition) {
+	pe.Enabled = compare(c, pe.ArithmeticRegister, pe.RoutingRegister, pe.Float)
+}
+func (pe *ProcessingElement) DoZcmp(c Condition) {
+	pe.Enabled = compare(c, pe.ArithmeticRegister, 0, pe.Float) // 0 is also the bits of +0.0
+}
+
+/// @return the result of the arithmetic instruction on x and y, e.g. x + y for isAdd, as int64 or float64 data.
+///
+/// Integer division by zero is 0. Float arithmetic follows IEEE 754: dividing a nonzero value by zero is an infinity,
+/// signed by the signs of both operands, 0/0 is NaN, and any arithmetic with a NaN is NaN.
+func arithmetic(op OpCode, x int64, y int64, float bool) int64 {
+	if float {
+		fx := math.Float64frombits(uint64(x))
+		fy := math.Float64frombits(uint64(y))
+		switch op {
+		case isAdd:
+			return int64(math.Float64bits(fx + fy))
+		case isSub:
+			return int64(math.Float64bits(fx - fy))
+		case isMul:
+			return int64(math.Float64bits(fx * fy))
+		case isDiv:
+			return int64(math.Float64bits(fx / fy))
+		}
+		return x
+	}
+	switch op {
+	case isAdd:
+		return x + y
+	case isSub:
+		return x - y
+	case isMul:
+		return x * y
+	case isDiv:
+		if y == 0 {
+			return 0
+		}
+		return x / y
+	}
+	return x
+}
+
+/// @return whether x compares to y by the condition, as int64 or float64 data
+func compare(c Condition, x int64, y int64, float bool) bool {
+	if float {
+		return c.HoldsFloat(math.Float64frombits(uint64(x)), math.Float64frombits(uint64(y)))
+	}
+	return c.Holds(x, y)
 }
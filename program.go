@@ -3,10 +3,44 @@ package main
 type Program interface {
 	PushMem(instruction OpCode, param byte, memParam uint16)
 	Push(instruction OpCode, params []byte)
-	Size() int64 /// @todo fix Ldxi to take more than a byte. This means we're limited to 255-inst programs :(
-	Save(file string) error
-	DataOp(cu *ControlUnitData, data byte) (address uint16)
+	Size() int64
+	Save(file string, header ProgramHeader) error
+	StoreData(address int, values ...int64)
+	Data() []DataSegment
 	At(index int64) []byte
+	OperandBits(op OpCode, operand int) uint ///< the width of the given operand's field in this encoding
+	Decode(instruction []byte) ExecuteParam
+	Arch() string ///< the name of the instruction encoding, as given to -arch
+}
+
+/// the Program with the widest operand fields, suggested when an operand doesn't fit
+var widestProgram Program = &Program32bit{}
+
+/// DataSegment is initial values for consecutive words of ControlUnitData.Memory, which may be CU or PE memory
+type DataSegment struct {
+	Address int
+	Values  []int64
+}
+
+/// DataSection is the initialized data of a program, which is copied into memory before the program runs
+type DataSection struct {
+	Segments []DataSegment
+}
+
+/// Store Pseudo-Operation
+///
+/// Puts the values in the data section, to be stored at the given memory address, which may be CU or PE memory.
+/// Values following the previous segment extend it.
+func (d *DataSection) StoreData(address int, values ...int64) {
+	if n := len(d.Segments); n != 0 && d.Segments[n-1].Address+len(d.Segments[n-1].Values) == address {
+		d.Segments[n-1].Values = append(d.Segments[n-1].Values, values...)
+		return
+	}
+	d.Segments = append(d.Segments, DataSegment{address, append([]int64{}, values...)})
+}
+
+func (d *DataSection) Data() []DataSegment {
+	return d.Segments
 }
 
 type ProgramReader interface {
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"strings"
+)
+
+/// SymbolKind is how a symbol was defined
+type SymbolKind int
+
+const (
+	skLabel SymbolKind = iota
+	skEquiv
+	skData
+	skBss
+	skInit ///< .init, which has no name
+)
+
+func (k SymbolKind) String() string {
+	switch k {
+	case skLabel:
+		return "label"
+	case skEquiv:
+		return "equiv"
+	case skData:
+		return "data"
+	case skBss:
+		return "bss"
+	case skInit:
+		return ".init"
+	}
+	return "NUL"
+}
+
+type symbolState int
+
+const (
+	ssUnresolved symbolState = iota
+	ssResolving
+	ssResolved
+	ssFailed
+)
+
+/// Symbol is a name defined by a label, or by an equiv, data, or bss pseudo-op.
+/// .init directives are also Symbols, without a name, so they are evaluated in order with the pseudo-ops.
+type Symbol struct {
+	Name  string ///< lower case
+	Kind  SymbolKind
+	Line  SourceLine ///< the line defining the symbol
+	Token Token      ///< the name, where it's defined
+	Value Token      ///< the value of equiv and data, the dimension of bss, or the address of .init
+	Init  *Token     ///< the initial values of bss and .init, if any
+	Index int        ///< for labels, the index of the instruction, among all instructions. For data, the index among all data.
+
+	previousBss *Symbol ///< for bss, the bss declared before it, which it's located after
+	state       symbolState
+	value       int64
+	width       int64 ///< for bss
+	height      int64 ///< for bss
+}
+
+/// SymbolTable holds every symbol in a program, so they may be referenced before they are defined.
+/// Symbols are resolved when they are first looked up, so definitions may refer to each other in any order, as long as they don't form a cycle.
+///
+/// Data pseudo-ops are stored at the end of CU memory, in the order they are declared.
+/// Bss pseudo-ops are stored in PE memory, in the order they are declared.
+/// Their values are stored in the program's data section.
+type SymbolTable struct {
+	cu        *ControlUnitData
+	base      int64 ///< the size of the program before assembling
+	symbols   map[string]*Symbol
+	labels    map[string]*Symbol ///< the first label of each name, even if an alias has the name, so duplicate labels are reported as such
+	PseudoOps []*Symbol          ///< every pseudo-op symbol, in source order
+	Diags     Diagnostics
+
+	addresses []int64 ///< the instruction index of each line, if lines assemble to more than one instruction
+	numData   int
+	lastBss   *Symbol
+}
+
+/// @param base the number of instructions already in the program, which labels are offset by
+func NewSymbolTable(cu *ControlUnitData, base int64) *SymbolTable {
+	return &SymbolTable{cu: cu, base: base, symbols: make(map[string]*Symbol), labels: make(map[string]*Symbol)}
+}
+
+/// Define adds the symbol to the table. If the name is already defined, a diagnostic is added instead.
+/// Aliases are defined before labels, so a label defined twice is reported as a duplicate label, even if an alias also has its name.
+func (t *SymbolTable) Define(sym *Symbol) {
+	if sym.Kind == skInit {
+		t.PseudoOps = append(t.PseudoOps, sym)
+		return
+	}
+	if sym.Kind == skLabel {
+		if previous, ok := t.labels[sym.Name]; ok {
+			t.Diags = append(t.Diags, NewDiagnostic(sym.Line, sym.Token, "'%s' is already defined at %s:%d", sym.Token.Text, previous.Line.File, previous.Line.Number))
+			return
+		}
+		t.labels[sym.Name] = sym
+	}
+	if previous, ok := t.symbols[sym.Name]; ok {
+		if (previous.Kind == skLabel) != (sym.Kind == skLabel) {
+			t.Diags = append(t.Diags, NewDiagnostic(sym.Line, sym.Token, "'%s' is defined as both a label and an alias, the %s is at %s:%d", sym.Token.Text, previous.Kind.String(), previous.Line.File, previous.Line.Number))
+		} else {
+			t.Diags = append(t.Diags, NewDiagnostic(sym.Line, sym.Token, "'%s' is already defined at %s:%d", sym.Token.Text, previous.Line.File, previous.Line.Number))
+		}
+		return
+	}
+	t.symbols[sym.Name] = sym
+
+	switch sym.Kind {
+	case skLabel:
+		return
+	case skData:
+		sym.Index = t.numData
+		t.numData++
+	case skBss:
+		sym.previousBss = t.lastBss
+		t.lastBss = sym
+	}
+	t.PseudoOps = append(t.PseudoOps, sym)
+}
+
+/// SetAddresses sets the instruction index of each line, which labels are evaluated from, and forgets the value of every symbol,
+/// so they are evaluated again. By default, each line is one instruction.
+/// @param addresses the index of each line, and of the end of the program, so labels on the last line may be evaluated
+func (t *SymbolTable) SetAddresses(addresses []int64) {
+	t.addresses = addresses
+	for _, sym := range t.symbols {
+		sym.state = ssUnresolved
+	}
+	for _, sym := range t.PseudoOps {
+		sym.state = ssUnresolved
+	}
+}
+
+/// Lookup is a SymbolLookup for the table
+func (t *SymbolTable) Lookup(name string) (int64, bool) {
+	sym, ok := t.symbols[strings.ToLower(name)]
+	if !ok {
+		return 0, false
+	}
+	return t.Resolve(sym), true
+}
+
+/// Resolve returns the value of the symbol, evaluating its definition if it hasn't been already.
+/// If the definition has errors, they are added to Diags once, and the value is 0.
+func (t *SymbolTable) Resolve(sym *Symbol) int64 {
+	switch sym.state {
+	case ssResolved, ssFailed:
+		return sym.value
+	case ssResolving:
+		t.fail(sym, NewDiagnostic(sym.Line, sym.Token, "'%s' is defined in terms of itself", sym.Token.Text))
+		return 0
+	}
+
+	sym.state = ssResolving
+	val, diag := t.evaluate(sym)
+	if sym.state == ssFailed {
+		return 0 // failed in a cycle
+	}
+	if diag != nil {
+		t.fail(sym, *diag)
+		return 0
+	}
+	sym.value = val
+	sym.state = ssResolved
+	return val
+}
+
+func (t *SymbolTable) fail(sym *Symbol, diag Diagnostic) {
+	t.Diags = append(t.Diags, diag)
+	sym.value = 0
+	sym.state = ssFailed
+}
+
+func (t *SymbolTable) bytesPerPe() int {
+	return len(t.cu.Memory) / (len(t.cu.PE) + 1)
+}
+
+func (t *SymbolTable) evaluate(sym *Symbol) (int64, *Diagnostic) {
+	switch sym.Kind {
+	case skLabel:
+		if t.addresses != nil {
+			return t.base + t.addresses[sym.Index], nil
+		}
+		return t.base + int64(sym.Index), nil
+	case skEquiv:
+		return EvaluateExpression(sym.Line, sym.Value, t.Lookup)
+	case skData:
+		address := len(t.cu.PE)*t.bytesPerPe() + sym.Index
+		if address >= len(t.cu.Memory) {
+			diag := NewDiagnostic(sym.Line, sym.Token, "not enough CU memory for data '%s', only %d data values fit", sym.Token.Text, t.bytesPerPe())
+			return 0, &diag
+		}
+		return int64(address), nil
+	case skBss:
+		return t.evaluateBss(sym)
+	case skInit:
+		address, diag := EvaluateExpression(sym.Line, sym.Value, t.Lookup)
+		if diag == nil && (address < 0 || address >= int64(len(t.cu.Memory))) {
+			d := NewDiagnostic(sym.Line, sym.Value, ".init address %d is outside memory, which is %d words", address, len(t.cu.Memory))
+			diag = &d
+		}
+		return address, diag
+	}
+	return 0, nil
+}
+
+/// @return the location of the bss in PE memory. Also sets its width and height.
+func (t *SymbolTable) evaluateBss(sym *Symbol) (int64, *Diagnostic) {
+	location := int64(0)
+	if previous := sym.previousBss; previous != nil {
+		location = t.Resolve(previous) + previous.height
+	}
+
+	dimension, _ := splitBssInit(sym.Value)
+	width, height, diag := EvaluateDimension(sym.Line, dimension, t.Lookup)
+	if diag != nil {
+		return 0, diag
+	}
+	if width < 1 || height < 1 {
+		diag := NewDiagnostic(sym.Line, sym.Value, "bss size %dx%d must be at least 1x1", width, height)
+		return 0, &diag
+	}
+	if width > int64(len(t.cu.PE)) {
+		diag := NewDiagnostic(sym.Line, dimension, "bss width %d exceeds the number of Vector Processing Elements (%d)", width, len(t.cu.PE))
+		return 0, &diag
+		/// @todo accomodate BSS matrices wider than len(cu.PE)
+	}
+	if height+location > int64(t.bytesPerPe()) {
+		diag := NewDiagnostic(sym.Line, dimension, "bss height %d at location %d exceeds the memory of Vector Processing Elements (%d)", height, location, t.bytesPerPe())
+		return 0, &diag
+	}
+	sym.width = width
+	sym.height = height
+	return location, nil
+}
@@ -11,18 +11,6 @@ const (
 	defaultMemoryPerElement   = 64
 )
 
-func testLoadMatrices(cu *ControlUnitData) {
-	n := 3
-	a := createMatrix(n)
-	b := createMatrix(n)
-	//	c := createMatrix()
-	offset := int64(0)
-	loadMatrix(cu, a, offset)
-	offset += int64(len(a)) // row length
-	loadMatrix(cu, b, offset)
-}
-
-// @todo fix movA toR
 func testLexer() {
 	input := `
 lim equiv 0
@@ -57,7 +45,7 @@ cmpx i,lim,loop
 	//	lines, program, err := ParsePseudoOperations(cu,
 	//	lines)
 	program := NewProgram24bit()
-	err := LexProgram(cu.Data(), input, program)
+	err := LexProgram(cu.Data(), "testLexer", input, program)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -94,7 +82,7 @@ func testMatrixMultiply() {
 
 	fmt.Println("main() Start State")
 	cu.PrintMachine()
-	fmt.Println("main() Multiplying...\n")
+	fmt.Print("main() Multiplying...\n\n")
 	matrixMultiply(cu, byte(n))
 	fmt.Println("main() Final State")
 	cu.PrintMachine()
@@ -176,10 +164,10 @@ func matrixMultiply(cu ControlUnit, matrixDimension byte) {
 	c := b + matrixDimension
 
 	var program Program24bit
-	n := program.DataOp(cu.Data(), matrixDimension)
-
-	//	zero :=
-	program.DataOp(cu.Data(), 0)
+	// data goes in CU memory, which is after the memory of every PE
+	bytesPerPe := len(cu.Data().Memory) / (len(cu.Data().PE) + 1)
+	n := uint16(len(cu.Data().PE) * bytesPerPe)
+	program.StoreData(int(n), int64(matrixDimension), 0) // n, zero
 
 	program.Push(isLdxi, []byte{i, 0, 0})
 	program.Push(isLdxi, []byte{j, 0, 0})
@@ -204,7 +192,7 @@ func matrixMultiply(cu ControlUnit, matrixDimension byte) {
 	fmt.Println(program)
 	fmt.Print("\n")
 	file := "program.simd"
-	err := program.Save(file)
+	err := program.Save(file, NewProgramHeader(at24bit, cu.Data()))
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+/// Topology is how the PEs are connected to each other, for routing instructions like shift
+type Topology uint32
+
+const (
+	topoRing      Topology = iota ///< each PE is connected to the next and previous, in a line whose ends meet
+	topoMesh                      ///< a square of PEs, each connected to the PEs ±1 and ±width from it, like the ILLIAC IV
+	topoHypercube                 ///< PEs are connected to the PEs whose numbers differ in one bit, the dimension
+)
+
+const isInvalidTopology = ^Topology(0)
+
+/// @return the topology with the given name, e.g. ring
+func StringToTopology(s string) Topology {
+	switch s {
+	case "ring":
+		return topoRing
+	case "mesh":
+		return topoMesh
+	case "hypercube":
+		return topoHypercube
+	}
+	return isInvalidTopology
+}
+
+func (t Topology) String() string {
+	switch t {
+	case topoRing:
+		return "ring"
+	case topoMesh:
+		return "mesh"
+	case topoHypercube:
+		return "hypercube"
+	}
+	return "NUL"
+}
+
+/// Network is the topology of a machine, and how many PEs it connects
+type Network struct {
+	Topology Topology
+	NumPE    int
+}
+
+/// Check returns an error if the topology can't connect this many PEs.
+/// A mesh must be square, and a hypercube a power of 2.
+func (n Network) Check() error {
+	switch n.Topology {
+	case topoMesh:
+		if n.Width()*n.Width() != n.NumPE {
+			return fmt.Errorf("a mesh needs a square number of PEs, like 16 or 64, not %d", n.NumPE)
+		}
+	case topoHypercube:
+		if n.NumPE == 0 || n.NumPE&(n.NumPE-1) != 0 {
+			return fmt.Errorf("a hypercube needs a power of 2 PEs, like 16 or 64, not %d", n.NumPE)
+		}
+	}
+	return nil
+}
+
+/// @return the number of PEs in each row of a mesh. Rings are a single row.
+func (n Network) Width() int {
+	if n.Topology != topoMesh {
+		return n.NumPE
+	}
+	width := 0
+	for (width+1)*(width+1) <= n.NumPE {
+		width++
+	}
+	return width
+}
+
+/// @return the number of dimensions of a hypercube, i.e. the bits in a PE's number
+func (n Network) Dimensions() int {
+	if n.NumPE <= 1 {
+		return 0
+	}
+	return bits.Len(uint(n.NumPE - 1))
+}
+
+/// @return whether the network has links in the given direction
+func (n Network) HasDirection(d Direction) bool {
+	switch n.Topology {
+	case topoRing:
+		return d == dirRight || d == dirLeft
+	case topoMesh:
+		return d == dirRight || d == dirLeft || d == dirDown || d == dirUp
+	case topoHypercube:
+		return d >= dirDim0 && int(d-dirDim0) < n.Dimensions()
+	}
+	return false
+}
+
+/// @return the directions of the network, for diagnostics, e.g. "right or left"
+func (n Network) DirectionNames() string {
+	switch n.Topology {
+	case topoRing:
+		return "right or left"
+	case topoMesh:
+		return "right, left, down or up"
+	case topoHypercube:
+		if n.Dimensions() == 0 {
+			return "none"
+		}
+		return fmt.Sprintf("dim0 to %s", (dirDim0 + Direction(n.Dimensions()-1)).String())
+	}
+	return "none"
+}
+
+/// @return the PE whose RR moves to PE i when routing distance steps in the direction, and whether there is one.
+///         A negative distance moves the other way.
+///         Rings and meshes route along the PE numbers, so moving right from the end of one row of a mesh goes to the start of the next.
+///         A hypercube route exchanges RRs with the neighbor across the dimension, once for each step, so there are no ends.
+/// @param wrap whether routes past one end of the PEs come in at the other, as for rotate. Otherwise those PEs receive nothing.
+func (n Network) Source(i int, d Direction, distance int64, wrap bool) (int, bool) {
+	if d >= dirDim0 {
+		if distance%2 == 0 {
+			return i, true
+		}
+		return i ^ 1<<uint(d-dirDim0), true
+	}
+
+	step := int64(1)
+	if d == dirDown || d == dirUp {
+		step = int64(n.Width())
+	}
+	if d == dirLeft || d == dirUp {
+		step = -step
+	}
+	count := int64(n.NumPE)
+	if wrap {
+		from := int64(i) - distance%count*step // routing count steps comes back around, and reducing first keeps the product from overflowing
+		return int((from%count + count) % count), true
+	}
+	if distance >= count || distance <= -count { // every route leaves the PEs, and the product could overflow
+		return i, false
+	}
+	from := int64(i) - distance*step
+	return int(from), from >= 0 && from < count
+}
+
+/// @return the label of PE i, when printing the machine. Hypercube PEs are numbered in binary, one bit per dimension.
+func (n Network) Label(i int) string {
+	if n.Topology == topoHypercube && n.Dimensions() != 0 {
+		label := fmt.Sprintf("%b", i)
+		return strings.Repeat("0", n.Dimensions()-len(label)) + label
+	}
+	return fmt.Sprint(i)
+}